@@ -9,8 +9,8 @@ import (
 type Routes struct{}
 
 // Add implements the RouterAdder interface to add all routes.
-func (Routes) Add(app *web.App, apiCfg v1.APIMuxConfig) {
-	rlgroup.Routes(app, rlgroup.Config{
+func (Routes) Add(app *web.App, apiCfg v1.APIMuxConfig) error {
+	return rlgroup.Routes(app, rlgroup.Config{
 		// TierConfig: map[string]ratelimiter.Tier{
 		// 	"basic": {
 		// 		Algo:     ratelimiter.TokenBucket,
@@ -18,8 +18,18 @@ func (Routes) Add(app *web.App, apiCfg v1.APIMuxConfig) {
 		// 		Capacity: 5,
 		// 	},
 		// },
-		TierConfig: apiCfg.Tiers,
-		Log:        apiCfg.Log,
-		KvStore:    apiCfg.RedisKv,
+		TierConfig:        apiCfg.Tiers,
+		DefaultTier:       apiCfg.DefaultTier,
+		TierResolver:      apiCfg.TierResolver,
+		MaxInFlight:       apiCfg.MaxInFlight,
+		InFlightOnFailure: apiCfg.InFlightOnFailure,
+		Hierarchy:         apiCfg.Hierarchy,
+		Global:            apiCfg.Global,
+		Priority:          apiCfg.Priority,
+		Penalty:           apiCfg.Penalty,
+		OperatorKey:       apiCfg.OperatorKey,
+		Log:               apiCfg.Log,
+		KvStore:           apiCfg.KvStore,
+		MaxDelay:          apiCfg.MaxDelay,
 	})
 }
@@ -2,30 +2,48 @@ package rlgroup
 
 import (
 	"context"
+	"errors"
 	"net/http"
 
+	"github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter/penalty"
+	"github.com/Zanda256/rate-limiter-go/business/web/v1/response"
 	"github.com/Zanda256/rate-limiter-go/foundation/logger"
 	"github.com/Zanda256/rate-limiter-go/foundation/web"
 )
 
 // Handlers manages the set of check endpoints.
 type Handlers struct {
-	log *logger.Logger
+	log  *logger.Logger
+	jail *penalty.Jail
 }
 
 // New constructs a handlers for route access.
-func New(log *logger.Logger) *Handlers {
+func New(log *logger.Logger, jail *penalty.Jail) *Handlers {
 	return &Handlers{
-		log: log,
+		log:  log,
+		jail: jail,
 	}
 }
 
 // type Handle func(http.ResponseWriter, *http.Request, httprouter.Params)
 func (h *Handlers) Limited(ctx context.Context, rw http.ResponseWriter, r *http.Request) error {
-	return web.Respond(context.Background(), rw, "Limited, don't over use me!", http.StatusOK)
+	return web.Respond(ctx, rw, "Limited, don't over use me!", http.StatusOK)
 }
 
 func (h *Handlers) UnLimited(ctx context.Context, rw http.ResponseWriter, r *http.Request) error {
 	h.log.Info(ctx, "Hit unlimited endpoint")
-	return web.Respond(context.Background(), rw, "Unlimited! Let's Go!", http.StatusOK)
+	return web.Respond(ctx, rw, "Unlimited! Let's Go!", http.StatusOK)
+}
+
+// ClearBan lifts the ban of the user named by the user query parameter.
+func (h *Handlers) ClearBan(ctx context.Context, rw http.ResponseWriter, r *http.Request) error {
+	user := r.URL.Query().Get("user")
+	if user == "" {
+		return response.NewError(errors.New("user is required"), http.StatusBadRequest)
+	}
+
+	if err := h.jail.Clear(ctx, user); err != nil {
+		return err
+	}
+	return web.Respond(ctx, rw, "Ban cleared", http.StatusOK)
 }
@@ -3,33 +3,140 @@ package rlgroup
 import (
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/Zanda256/rate-limiter-go/business/data/cache"
 	"github.com/Zanda256/rate-limiter-go/business/web/v1/mid"
 	ratelimiter "github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter"
+	"github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter/concurrency"
+	"github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter/penalty"
+	"github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter/priority"
 	"github.com/Zanda256/rate-limiter-go/foundation/logger"
 	"github.com/Zanda256/rate-limiter-go/foundation/web"
 )
 
 type Config struct {
-	TierConfig map[string]ratelimiter.Tier
-	KvStore    *cache.RedisCache
-	Log        *logger.Logger
+	TierConfig   map[string]ratelimiter.Tier
+	DefaultTier  string
+	TierResolver ratelimiter.TierResolver
+	MaxInFlight  int
+	// InFlightOnFailure is "closed" (default) or "open".
+	InFlightOnFailure string
+	Hierarchy         []ratelimiter.LevelConfig
+	Global            *ratelimiter.GlobalConfig
+	Priority          *priority.Config
+	Penalty           *penalty.Config
+	OperatorKey       string
+	KvStore           cache.Store
+	Log               *logger.Logger
+	// MaxDelay bounds how long a request may be queued by its limits.
+	MaxDelay time.Duration
 }
 
-func Routes(app *web.App, cfg Config) {
+func Routes(app *web.App, cfg Config) error {
 	const version = "v1"
 
-	rateLmt := ratelimiter.NewRateLimiter(ratelimiter.RateLimiterConfig{
-		Tier:    cfg.TierConfig["basic"],
-		KvStore: cfg.KvStore,
-		Log:     cfg.Log,
+	rateLmt, err := ratelimiter.NewTieredLimiter(ratelimiter.TieredLimiterConfig{
+		Tiers:       cfg.TierConfig,
+		DefaultTier: cfg.DefaultTier,
+		Resolver:    cfg.TierResolver,
+		KvStore:     cfg.KvStore,
+		Log:         cfg.Log,
 	})
-	fmt.Printf("\nTier: %+v\n", cfg.TierConfig["basic"])
-	rateLmtMiddleware := mid.RateLimit(rateLmt)
+	if err != nil {
+		return fmt.Errorf("rate limiter: %w", err)
+	}
+	var hierarchy *ratelimiter.Hierarchy
+	if len(cfg.Hierarchy) > 0 {
+		hierarchy, err = ratelimiter.NewHierarchy(ratelimiter.HierarchyConfig{
+			Levels:  cfg.Hierarchy,
+			KvStore: cfg.KvStore,
+			Log:     cfg.Log,
+		})
+		if err != nil {
+			return fmt.Errorf("limit hierarchy: %w", err)
+		}
+	}
 
-	hdl := New(cfg.Log)
+	var global *ratelimiter.GlobalLimit
+	if cfg.Global != nil {
+		global, err = ratelimiter.NewGlobalLimit(ratelimiter.GlobalLimitConfig{
+			Global:  *cfg.Global,
+			KvStore: cfg.KvStore,
+			Log:     cfg.Log,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	var shedder *priority.Shedder
+	if cfg.Priority != nil {
+		shedder, err = priority.NewShedder(priority.ShedderConfig{
+			Store:  cfg.KvStore,
+			Log:    cfg.Log,
+			Config: *cfg.Priority,
+		})
+		if err != nil {
+			return fmt.Errorf("priority shedder: %w", err)
+		}
+	}
+
+	var jail *penalty.Jail
+	if cfg.Penalty != nil {
+		jail, err = penalty.NewJail(penalty.JailConfig{
+			Store:  cfg.KvStore,
+			Log:    cfg.Log,
+			Config: *cfg.Penalty,
+		})
+		if err != nil {
+			return fmt.Errorf("penalty jail: %w", err)
+		}
+	}
+
+	rateLmtMiddleware := mid.RateLimit(mid.RateLimitConfig{
+		Log:       cfg.Log,
+		Limiter:   rateLmt,
+		Hierarchy: hierarchy,
+		Global:    global,
+		Shedder:   shedder,
+		Jail:      jail,
+		Cost:      mid.FixedCost(1),
+		MaxDelay:  cfg.MaxDelay,
+	})
+
+	// The in-flight limit runs first, so that the requests it turns away
+	// aren't charged to the caller's rate limits.
+	var limitedMiddleware []web.Middleware
+	if cfg.MaxInFlight > 0 {
+		switch cfg.InFlightOnFailure {
+		case "", ratelimiter.FailClosed, ratelimiter.FailOpen:
+		default:
+			return fmt.Errorf("in-flight limit: unsupported failure mode %q", cfg.InFlightOnFailure)
+		}
+
+		inFlight := concurrency.NewLimiter(concurrency.LimiterConfig{
+			Store:       cfg.KvStore,
+			Log:         cfg.Log,
+			MaxInFlight: cfg.MaxInFlight,
+		})
+		limitedMiddleware = append(limitedMiddleware, mid.Concurrency(mid.ConcurrencyConfig{
+			Log:       cfg.Log,
+			Limiter:   inFlight,
+			OnFailure: cfg.InFlightOnFailure,
+		}))
+	}
+	limitedMiddleware = append(limitedMiddleware, rateLmtMiddleware)
+
+	hdl := New(cfg.Log, jail)
 	app.HandlePath(http.MethodGet, version, "/", hdl.UnLimited)
-	app.HandlePath(http.MethodGet, version, "/limited", hdl.Limited, rateLmtMiddleware)
+	app.HandlePath(http.MethodGet, version, "/limited", hdl.Limited, limitedMiddleware...)
 	app.HandlePath(http.MethodGet, version, "/unlimited", hdl.UnLimited)
+
+	// Bans can only be lifted over the API when an operator key is set.
+	if jail != nil && cfg.OperatorKey != "" {
+		app.HandlePath(http.MethodDelete, version, "/penalties", hdl.ClearBan, mid.Operator(cfg.OperatorKey))
+	}
+
+	return nil
 }
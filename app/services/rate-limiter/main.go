@@ -3,11 +3,14 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"expvar"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -15,6 +18,8 @@ import (
 	"github.com/Zanda256/rate-limiter-go/business/data/cache"
 	v1 "github.com/Zanda256/rate-limiter-go/business/web/v1"
 	ratelimiter "github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter"
+	"github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter/penalty"
+	"github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter/priority"
 	"github.com/Zanda256/rate-limiter-go/foundation/logger"
 )
 
@@ -66,12 +71,45 @@ func run(ctx context.Context, log *logger.Logger) error {
 			IdleTimeout     time.Duration // `conf:"default:120s"`
 			ShutdownTimeout time.Duration // `conf:"default:20s,mask"`
 			APIHost         string        // `conf:"default:0.0.0.0:3000"`
+			DebugHost       string        // `conf:"default:localhost:4000"`
 
 		}
+		StoreConf struct {
+			Kind string
+		}
 		RedisConf struct {
-			URL string
+			URL     string
+			Config  cache.RedisConfig
+			Breaker cache.BreakerSettings
+		}
+		MemoryConf struct {
+			Shards  int
+			MaxKeys int
 		}
 		RateLimitConf map[string]ratelimiter.Tier
+		TierConf      struct {
+			Default  string
+			Resolver string
+			Header   string
+			Trusted  []string
+			Hash     string
+			Users    map[string]string
+		}
+		ConcurrencyConf struct {
+			MaxInFlight int
+			OnFailure   string
+		}
+		HierarchyConf []ratelimiter.LevelConfig
+		GlobalConf    struct {
+			Limit *ratelimiter.GlobalConfig
+		}
+		PriorityConf struct {
+			Shedding *priority.Config
+		}
+		PenaltyConf struct {
+			Jail        *penalty.Config
+			OperatorKey string
+		}
 	)
 
 	// map[string]ratelimiter.Tier{
@@ -85,20 +123,37 @@ func run(ctx context.Context, log *logger.Logger) error {
 	cfg := struct {
 		Version
 		Web
+		StoreConf
 		RedisConf
+		MemoryConf
 		RateLimitConf
+		TierConf
+		ConcurrencyConf
+		HierarchyConf
+		GlobalConf
+		PriorityConf
+		PenaltyConf
 	}{
 		Version: Version{
 			Build: build,
 			Desc:  "My first attempt at replicating the project",
 		},
-		Web: Web{
-			ReadTimeout:     5 * time.Second,
-			WriteTimeout:    10 * time.Second,
-			IdleTimeout:     120 * time.Second,
-			ShutdownTimeout: 20 * time.Second,
-			APIHost:         "0.0.0.0:3000",
-		},
+		Web: func() Web {
+			wCfg := Web{
+				ReadTimeout:     5 * time.Second,
+				WriteTimeout:    10 * time.Second,
+				IdleTimeout:     120 * time.Second,
+				ShutdownTimeout: 20 * time.Second,
+				APIHost:         "0.0.0.0:3000",
+				DebugHost:       "localhost:4000",
+			}
+			// The debug endpoints expose the internals of the service, so
+			// they are only served to other hosts when asked to.
+			if v := os.Getenv("DEBUG_HOST"); v != "" {
+				wCfg.DebugHost = v
+			}
+			return wCfg
+		}(),
 		RateLimitConf: func() RateLimitConf {
 			rlCfg := RateLimitConf{}
 			jsonStr := os.Getenv("TIER_CONFIG")
@@ -108,27 +163,187 @@ func run(ctx context.Context, log *logger.Logger) error {
 			}
 			return rlCfg
 		}(),
+		StoreConf: func() StoreConf {
+			return StoreConf{
+				Kind: os.Getenv("STORE"),
+			}
+		}(),
 		RedisConf: func() RedisConf {
-			return RedisConf{
+			rCfg := RedisConf{
 				URL: os.Getenv("REDIS_URL"),
 			}
+			if jsonStr := os.Getenv("REDIS_CONFIG"); jsonStr != "" {
+				if err := json.Unmarshal([]byte(jsonStr), &rCfg.Config); err != nil {
+					panic(err)
+				}
+			}
+			// Secrets can be kept out of the json configuration.
+			if v := os.Getenv("REDIS_PASSWORD"); v != "" {
+				rCfg.Config.Password = v
+			}
+			if rCfg.URL != "" {
+				rCfg.Config.Addrs = strings.Split(rCfg.URL, ",")
+			}
+			if jsonStr := os.Getenv("BREAKER_CONFIG"); jsonStr != "" {
+				if err := json.Unmarshal([]byte(jsonStr), &rCfg.Breaker); err != nil {
+					panic(err)
+				}
+			}
+			return rCfg
+		}(),
+		MemoryConf: func() MemoryConf {
+			mCfg := MemoryConf{}
+			for env, dst := range map[string]*int{
+				"MEMORY_SHARDS":   &mCfg.Shards,
+				"MEMORY_MAX_KEYS": &mCfg.MaxKeys,
+			} {
+				if v := os.Getenv(env); v != "" {
+					n, err := strconv.Atoi(v)
+					if err != nil {
+						panic(err)
+					}
+					*dst = n
+				}
+			}
+			return mCfg
+		}(),
+		TierConf: func() TierConf {
+			tCfg := TierConf{
+				Default:  os.Getenv("DEFAULT_TIER"),
+				Resolver: os.Getenv("TIER_RESOLVER"),
+				Header:   os.Getenv("TIER_HEADER"),
+				Hash:     os.Getenv("TIER_HASH"),
+			}
+			if v := os.Getenv("TIER_TRUSTED"); v != "" {
+				tCfg.Trusted = strings.Split(v, ",")
+			}
+			if jsonStr := os.Getenv("TIER_USERS"); jsonStr != "" {
+				if err := json.Unmarshal([]byte(jsonStr), &tCfg.Users); err != nil {
+					panic(err)
+				}
+			}
+			return tCfg
+		}(),
+		ConcurrencyConf: func() ConcurrencyConf {
+			cCfg := ConcurrencyConf{
+				OnFailure: os.Getenv("IN_FLIGHT_ON_FAILURE"),
+			}
+			if v := os.Getenv("MAX_IN_FLIGHT"); v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					panic(err)
+				}
+				cCfg.MaxInFlight = n
+			}
+			return cCfg
+		}(),
+		HierarchyConf: func() HierarchyConf {
+			hCfg := HierarchyConf{}
+			if jsonStr := os.Getenv("HIERARCHY_CONFIG"); jsonStr != "" {
+				if err := json.Unmarshal([]byte(jsonStr), &hCfg); err != nil {
+					panic(err)
+				}
+			}
+			return hCfg
+		}(),
+		GlobalConf: func() GlobalConf {
+			gCfg := GlobalConf{}
+			if jsonStr := os.Getenv("GLOBAL_LIMIT"); jsonStr != "" {
+				if err := json.Unmarshal([]byte(jsonStr), &gCfg.Limit); err != nil {
+					panic(err)
+				}
+			}
+			return gCfg
+		}(),
+		PriorityConf: func() PriorityConf {
+			pCfg := PriorityConf{}
+			if jsonStr := os.Getenv("PRIORITY_CONFIG"); jsonStr != "" {
+				if err := json.Unmarshal([]byte(jsonStr), &pCfg.Shedding); err != nil {
+					panic(err)
+				}
+			}
+			return pCfg
+		}(),
+		PenaltyConf: func() PenaltyConf {
+			pCfg := PenaltyConf{
+				OperatorKey: os.Getenv("OPERATOR_KEY"),
+			}
+			if jsonStr := os.Getenv("PENALTY_CONFIG"); jsonStr != "" {
+				if err := json.Unmarshal([]byte(jsonStr), &pCfg.Jail); err != nil {
+					panic(err)
+				}
+			}
+			return pCfg
 		}(),
 	}
 
 	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM)
 
-	redis := cache.NewRedisCache(cfg.RedisConf.URL)
+	var store cache.Store
+	switch cfg.StoreConf.Kind {
+	case "", "redis":
+		rdb, err := cache.NewRedisCache(cfg.RedisConf.Config)
+		if err != nil {
+			return fmt.Errorf("constructing redis store: %w", err)
+		}
+		defer rdb.Close()
+		store = cache.NewBreaker(cache.BreakerConfig{
+			Log:      log,
+			Store:    rdb,
+			Settings: cfg.RedisConf.Breaker,
+		})
+	case "memory":
+		mem := cache.NewMemoryCache(cache.MemoryConfig{
+			Shards:  cfg.MemoryConf.Shards,
+			MaxKeys: cfg.MemoryConf.MaxKeys,
+		})
+		defer mem.Close()
+		store = mem
+	default:
+		return fmt.Errorf("unknown store %q", cfg.StoreConf.Kind)
+	}
+
+	defaultTier := cfg.TierConf.Default
+	if defaultTier == "" {
+		defaultTier = ratelimiter.DefaultTier
+	}
+
+	tierResolver, err := ratelimiter.NewTierResolver(ratelimiter.ResolverConfig{
+		Kind:    cfg.TierConf.Resolver,
+		Default: defaultTier,
+		Users:   cfg.TierConf.Users,
+		Store:   store,
+		Hash:    cfg.TierConf.Hash,
+		Header:  cfg.TierConf.Header,
+		Trusted: cfg.TierConf.Trusted,
+	})
+	if err != nil {
+		return fmt.Errorf("constructing tier resolver: %w", err)
+	}
 
 	cfgMux := v1.APIMuxConfig{
-		Tiers:    cfg.RateLimitConf,
-		RedisKv:  redis,
-		Build:    build,
-		Shutdown: shutdown,
-		Log:      log,
+		Tiers:             cfg.RateLimitConf,
+		DefaultTier:       defaultTier,
+		TierResolver:      tierResolver,
+		MaxInFlight:       cfg.ConcurrencyConf.MaxInFlight,
+		InFlightOnFailure: cfg.ConcurrencyConf.OnFailure,
+		Hierarchy:         cfg.HierarchyConf,
+		Global:            cfg.GlobalConf.Limit,
+		Priority:          cfg.PriorityConf.Shedding,
+		Penalty:           cfg.PenaltyConf.Jail,
+		OperatorKey:       cfg.PenaltyConf.OperatorKey,
+		KvStore:           store,
+		MaxDelay:          cfg.Web.WriteTimeout,
+		Build:             build,
+		Shutdown:          shutdown,
+		Log:               log,
 	}
 
-	apiMux := v1.APIMux(cfgMux, handlers.Routes{})
+	apiMux, err := v1.APIMux(cfgMux, handlers.Routes{})
+	if err != nil {
+		return fmt.Errorf("constructing api mux: %w", err)
+	}
 
 	api := http.Server{
 		Addr:         cfg.Web.APIHost,
@@ -146,6 +361,19 @@ func run(ctx context.Context, log *logger.Logger) error {
 		serverErrors <- api.ListenAndServe()
 	}()
 
+	// -------------------------------------------------------------------------
+	// Start Debug Service
+
+	go func() {
+		mux := http.NewServeMux()
+		mux.Handle("/debug/vars", expvar.Handler())
+
+		log.Info(ctx, "startup", "status", "debug router started", "host", cfg.Web.DebugHost)
+		if err := http.ListenAndServe(cfg.Web.DebugHost, mux); err != nil {
+			log.Error(ctx, "shutdown", "status", "debug router closed", "host", cfg.Web.DebugHost, "msg", err)
+		}
+	}()
+
 	// -------------------------------------------------------------------------
 	// Shutdown
 
@@ -0,0 +1,299 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/Zanda256/rate-limiter-go/foundation/logger"
+	redis "github.com/redis/go-redis/v9"
+)
+
+// States of a circuit breaker.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// Defaults used for the breaker settings that aren't configured.
+const (
+	DefaultBreakerThreshold = 5
+	DefaultBreakerCooldown  = 10
+)
+
+// ErrCircuitOpen is returned instead of calling the store while the breaker
+// is open.
+var ErrCircuitOpen = errors.New("store circuit breaker is open")
+
+// breakerMetrics is published at /debug/vars. It holds the current state of
+// the breaker and counts how often it opened, the calls that failed and the
+// calls it turned away.
+var breakerMetrics = expvar.NewMap("storeBreaker")
+
+// RemoteStore is a store with all the optional capabilities, like
+// RedisCache.
+type RemoteStore interface {
+	Store
+	ScriptRunner
+	LogStore
+	HashStore
+}
+
+// Breaker is a circuit breaker around a remote store. It opens after
+// Threshold calls in a row failed to reach the store, and then fails every
+// call straight away with ErrCircuitOpen, so a sick store isn't hammered by
+// every request. Once Cooldown has passed a single call is let through to
+// probe the store: the breaker closes when it succeeds and opens again when
+// it doesn't. Errors the store replied with, such as a missing key, mean it
+// is reachable and don't count as failures.
+type Breaker struct {
+	Log       *logger.Logger
+	Store     RemoteStore
+	Threshold int
+	Cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// BreakerSettings declares when the breaker opens and for how long.
+// Durations are in seconds.
+type BreakerSettings struct {
+	Threshold int `json:"threshold,omitempty"`
+	Cooldown  int `json:"cooldown,omitempty"`
+}
+
+type BreakerConfig struct {
+	Log      *logger.Logger
+	Store    RemoteStore
+	Settings BreakerSettings
+}
+
+// NewBreaker constructs a closed breaker around the store. Settings that
+// aren't configured get their defaults.
+func NewBreaker(cfg BreakerConfig) *Breaker {
+	threshold := cfg.Settings.Threshold
+	if threshold < 1 {
+		threshold = DefaultBreakerThreshold
+	}
+	cooldown := cfg.Settings.Cooldown
+	if cooldown < 1 {
+		cooldown = DefaultBreakerCooldown
+	}
+
+	b := Breaker{
+		Log:       cfg.Log,
+		Store:     cfg.Store,
+		Threshold: threshold,
+		Cooldown:  time.Duration(cooldown) * time.Second,
+		state:     BreakerClosed,
+	}
+	b.publish()
+
+	return &b
+}
+
+// State returns the current state of the breaker.
+func (b *Breaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state
+}
+
+func (b *Breaker) StoreValue(ctx context.Context, key string, value any, ttl int) (any, error) {
+	return guard(ctx, b, func() (any, error) {
+		return b.Store.StoreValue(ctx, key, value, ttl)
+	})
+}
+
+func (b *Breaker) RetrieveValue(ctx context.Context, key string) (any, error) {
+	return guard(ctx, b, func() (any, error) {
+		return b.Store.RetrieveValue(ctx, key)
+	})
+}
+
+func (b *Breaker) Increment(ctx context.Context, key string, n int64) (int64, error) {
+	return guard(ctx, b, func() (int64, error) {
+		return b.Store.Increment(ctx, key, n)
+	})
+}
+
+func (b *Breaker) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	_, err := guard(ctx, b, func() (any, error) {
+		return nil, b.Store.Expire(ctx, key, ttl)
+	})
+	return err
+}
+
+func (b *Breaker) CompareAndSet(ctx context.Context, key string, old string, value any, ttl time.Duration) (bool, error) {
+	return guard(ctx, b, func() (bool, error) {
+		return b.Store.CompareAndSet(ctx, key, old, value, ttl)
+	})
+}
+
+func (b *Breaker) DeleteValues(ctx context.Context, keys ...string) error {
+	_, err := guard(ctx, b, func() (any, error) {
+		return nil, b.Store.DeleteValues(ctx, keys...)
+	})
+	return err
+}
+
+func (b *Breaker) RunScript(ctx context.Context, s *Script, keys []string, args ...any) (any, error) {
+	return guard(ctx, b, func() (any, error) {
+		return b.Store.RunScript(ctx, s, keys, args...)
+	})
+}
+
+func (b *Breaker) AppendToLog(ctx context.Context, key string, score, minScore int64, ttl time.Duration, members ...string) (int64, int64, error) {
+	var oldest int64
+	count, err := guard(ctx, b, func() (int64, error) {
+		var count int64
+		var err error
+		count, oldest, err = b.Store.AppendToLog(ctx, key, score, minScore, ttl, members...)
+		return count, err
+	})
+	return count, oldest, err
+}
+
+func (b *Breaker) RemoveFromLog(ctx context.Context, key string, members ...string) error {
+	_, err := guard(ctx, b, func() (any, error) {
+		return nil, b.Store.RemoveFromLog(ctx, key, members...)
+	})
+	return err
+}
+
+func (b *Breaker) RetrieveHashField(ctx context.Context, key string, field string) (string, error) {
+	return guard(ctx, b, func() (string, error) {
+		return b.Store.RetrieveHashField(ctx, key, field)
+	})
+}
+
+// guard calls fn if the breaker lets the call through, and records whether
+// it reached the store.
+func guard[T any](ctx context.Context, b *Breaker, fn func() (T, error)) (T, error) {
+	if err := b.allow(ctx); err != nil {
+		var zero T
+		return zero, err
+	}
+
+	v, err := fn()
+	b.record(ctx, err)
+	return v, err
+}
+
+// allow reports whether a call may go to the store, moving an open breaker
+// to half-open once its cooldown has passed.
+func (b *Breaker) allow(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.Cooldown {
+			breakerMetrics.Add("rejected", 1)
+			return ErrCircuitOpen
+		}
+		b.transition(ctx, BreakerHalfOpen)
+		b.probing = true
+		return nil
+
+	case BreakerHalfOpen:
+		// Only one probe at a time.
+		if b.probing {
+			breakerMetrics.Add("rejected", 1)
+			return ErrCircuitOpen
+		}
+		b.probing = true
+		return nil
+	}
+	return nil
+}
+
+// record updates the breaker with the outcome of a call.
+func (b *Breaker) record(ctx context.Context, err error) {
+	failed := isFailure(err)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if failed {
+		breakerMetrics.Add("failures", 1)
+	}
+
+	switch b.state {
+	case BreakerClosed:
+		if !failed {
+			b.failures = 0
+			return
+		}
+		if b.failures++; b.failures >= b.Threshold {
+			b.open(ctx, err)
+		}
+
+	case BreakerHalfOpen:
+		b.probing = false
+		if errors.Is(err, context.Canceled) {
+			// The probe was given up on, the next call probes instead.
+			return
+		}
+		if failed {
+			b.open(ctx, err)
+			return
+		}
+		b.failures = 0
+		b.transition(ctx, BreakerClosed)
+
+	case BreakerOpen:
+		// A call let through before the breaker opened has nothing to add.
+	}
+}
+
+// open opens the breaker after the call that failed with err. It must be
+// called with the mutex held.
+func (b *Breaker) open(ctx context.Context, err error) {
+	b.Log.Warn(ctx, "store circuit breaker opened", "from", b.state, "cooldown", b.Cooldown.String(), "msg", err)
+
+	b.state = BreakerOpen
+	b.openedAt = time.Now()
+	breakerMetrics.Add("opened", 1)
+	b.publish()
+}
+
+// transition moves the breaker to a state other than open, logging and
+// publishing the change. It must be called with the mutex held.
+func (b *Breaker) transition(ctx context.Context, state string) {
+	b.Log.Info(ctx, "store circuit breaker state changed", "from", b.state, "to", state)
+
+	b.state = state
+	b.publish()
+}
+
+// publish exposes the current state in the breaker metrics.
+func (b *Breaker) publish() {
+	var state expvar.String
+	state.Set(b.state)
+	breakerMetrics.Set("state", &state)
+}
+
+// isFailure reports whether err means the store couldn't be reached. Errors
+// redis replied with, missing keys and calls the caller gave up on aren't
+// the store's fault.
+func isFailure(err error) bool {
+	if err == nil || errors.Is(err, ErrKeyNotFound) || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var rerr redis.Error
+	return !errors.As(err, &rerr)
+}
+
+// Interfaces the breaker implements, so that limiters keep using scripts and
+// native data types through it.
+var _ RemoteStore = (*Breaker)(nil)
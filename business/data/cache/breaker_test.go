@@ -0,0 +1,154 @@
+package cache_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/Zanda256/rate-limiter-go/business/data/cache"
+	"github.com/Zanda256/rate-limiter-go/foundation/logger"
+)
+
+// flakyStore is a remote store whose calls fail with err while it is set.
+type flakyStore struct {
+	*cache.MemoryCache
+	err   error
+	calls int
+}
+
+func (s *flakyStore) RetrieveValue(ctx context.Context, key string) (any, error) {
+	s.calls++
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.MemoryCache.RetrieveValue(ctx, key)
+}
+
+func (s *flakyStore) RunScript(ctx context.Context, sc *cache.Script, keys []string, args ...any) (any, error) {
+	return nil, errors.New("not supported")
+}
+
+func (s *flakyStore) AppendToLog(ctx context.Context, key string, score, minScore int64, ttl time.Duration, members ...string) (int64, int64, error) {
+	return 0, 0, errors.New("not supported")
+}
+
+func (s *flakyStore) RemoveFromLog(ctx context.Context, key string, members ...string) error {
+	return errors.New("not supported")
+}
+
+func (s *flakyStore) RetrieveHashField(ctx context.Context, key string, field string) (string, error) {
+	return "", errors.New("not supported")
+}
+
+// replyError is an error redis replied with.
+type replyError string
+
+func (e replyError) Error() string { return string(e) }
+func (replyError) RedisError()     {}
+
+func newBreaker(t *testing.T) (*cache.Breaker, *flakyStore) {
+	t.Helper()
+
+	mc := cache.NewMemoryCache(cache.MemoryConfig{})
+	t.Cleanup(mc.Close)
+
+	store := flakyStore{MemoryCache: mc}
+	b := cache.NewBreaker(cache.BreakerConfig{
+		Log:      logger.New(io.Discard, logger.LevelError, "TEST", func(context.Context) string { return "" }),
+		Store:    &store,
+		Settings: cache.BreakerSettings{Threshold: 3},
+	})
+	b.Cooldown = 20 * time.Millisecond
+
+	return b, &store
+}
+
+func TestBreakerOpensAfterThreshold(t *testing.T) {
+	b, store := newBreaker(t)
+	ctx := context.Background()
+
+	store.err = errors.New("dial tcp: connection refused")
+	for i := 0; i < 3; i++ {
+		if state := b.State(); state != cache.BreakerClosed {
+			t.Fatalf("after %d failures: got %s, want closed", i, state)
+		}
+		if _, err := b.RetrieveValue(ctx, "key"); !errors.Is(err, store.err) {
+			t.Fatalf("call %d: got %v, want the store error", i+1, err)
+		}
+	}
+	if state := b.State(); state != cache.BreakerOpen {
+		t.Fatalf("got %s, want open", state)
+	}
+
+	// An open breaker doesn't call the store.
+	calls := store.calls
+	if _, err := b.RetrieveValue(ctx, "key"); !errors.Is(err, cache.ErrCircuitOpen) {
+		t.Fatalf("got %v, want ErrCircuitOpen", err)
+	}
+	if store.calls != calls {
+		t.Errorf("the store was called while the breaker was open")
+	}
+}
+
+func TestBreakerProbe(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		state string
+	}{
+		{name: "store still down", err: errors.New("i/o timeout"), state: cache.BreakerOpen},
+		{name: "store back", state: cache.BreakerClosed},
+		{name: "store replied", err: replyError("WRONGTYPE"), state: cache.BreakerClosed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, store := newBreaker(t)
+			ctx := context.Background()
+
+			store.err = errors.New("dial tcp: connection refused")
+			for i := 0; i < 3; i++ {
+				b.RetrieveValue(ctx, "key")
+			}
+			if state := b.State(); state != cache.BreakerOpen {
+				t.Fatalf("got %s, want open", state)
+			}
+
+			time.Sleep(2 * b.Cooldown)
+
+			store.err = tt.err
+			b.RetrieveValue(ctx, "key")
+			if state := b.State(); state != tt.state {
+				t.Errorf("after the probe: got %s, want %s", state, tt.state)
+			}
+		})
+	}
+}
+
+func TestBreakerIgnoresReplies(t *testing.T) {
+	b, store := newBreaker(t)
+	ctx := context.Background()
+
+	// Errors redis replied with mean it is reachable.
+	store.err = replyError("NOSCRIPT")
+	for i := 0; i < 5; i++ {
+		b.RetrieveValue(ctx, "key")
+	}
+	if state := b.State(); state != cache.BreakerClosed {
+		t.Errorf("got %s, want closed", state)
+	}
+
+	// A success resets the count of failures in a row.
+	store.err = errors.New("dial tcp: connection refused")
+	b.RetrieveValue(ctx, "key")
+	b.RetrieveValue(ctx, "key")
+	store.err = nil
+	b.RetrieveValue(ctx, "key")
+	store.err = errors.New("dial tcp: connection refused")
+	b.RetrieveValue(ctx, "key")
+	b.RetrieveValue(ctx, "key")
+	if state := b.State(); state != cache.BreakerClosed {
+		t.Errorf("got %s, want closed", state)
+	}
+}
@@ -0,0 +1,354 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"encoding"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults used for the memory store settings that aren't configured.
+const (
+	DefaultShards          = 32
+	DefaultJanitorInterval = time.Minute
+)
+
+// ErrNotInteger is returned when incrementing a value that isn't an integer.
+var ErrNotInteger = errors.New("value is not an integer")
+
+type memoryEntry struct {
+	key       string
+	value     string
+	expiresAt time.Time
+}
+
+func (e *memoryEntry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && !now.Before(e.expiresAt)
+}
+
+// shard is one independently locked part of the memory store. Its entries are
+// kept in least recently used order, most recent first, so that the oldest
+// can be evicted when the store is full. keys counts the entries of every
+// shard of the store.
+type shard struct {
+	mu    sync.Mutex
+	items map[string]*list.Element
+	lru   *list.List
+	keys  *atomic.Int64
+}
+
+// MemoryCache is an in-process Store for single instance deployments and
+// tests. Keys are spread over shards to keep lock contention down. Expired
+// keys are dropped when they are read and by a background janitor. When
+// MaxKeys is set, adding a key to a full store evicts the least recently used
+// key of its shard, or of the next shard that has an older key, so a flood of
+// unique keys can't exhaust memory. Concurrent writes may go over MaxKeys for
+// as long as they take.
+type MemoryCache struct {
+	shards  []*shard
+	keys    atomic.Int64
+	maxKeys int
+	stop    chan struct{}
+	once    sync.Once
+}
+
+type MemoryConfig struct {
+	Shards          int
+	MaxKeys         int
+	JanitorInterval time.Duration
+}
+
+// NewMemoryCache constructs a memory store and starts its janitor. Close stops
+// the janitor.
+func NewMemoryCache(cfg MemoryConfig) *MemoryCache {
+	n := cfg.Shards
+	if n < 1 {
+		n = DefaultShards
+	}
+	interval := cfg.JanitorInterval
+	if interval <= 0 {
+		interval = DefaultJanitorInterval
+	}
+
+	mc := &MemoryCache{
+		shards:  make([]*shard, n),
+		maxKeys: max(0, cfg.MaxKeys),
+		stop:    make(chan struct{}),
+	}
+	for i := range mc.shards {
+		mc.shards[i] = &shard{
+			items: make(map[string]*list.Element),
+			lru:   list.New(),
+			keys:  &mc.keys,
+		}
+	}
+
+	go mc.janitor(interval)
+
+	return mc
+}
+
+// Close stops the janitor. It is safe to call it more than once.
+func (mc *MemoryCache) Close() {
+	mc.once.Do(func() {
+		close(mc.stop)
+	})
+}
+
+func (mc *MemoryCache) StoreValue(ctx context.Context, key string, value any, ttl int) (any, error) {
+	v, err := encode(value)
+	if err != nil {
+		return nil, err
+	}
+
+	defer mc.evict(key)
+
+	s := mc.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.set(key, v, expiry(time.Now(), time.Minute*time.Duration(ttl)))
+	return value, nil
+}
+
+func (mc *MemoryCache) RetrieveValue(ctx context.Context, key string) (any, error) {
+	s := mc.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.get(key, time.Now())
+	if e == nil {
+		return nil, nil
+	}
+	return e.value, nil
+}
+
+// Increment adds n to the integer stored at key, creating it at zero first if
+// needed, and returns the result. The key's expiry is left alone.
+func (mc *MemoryCache) Increment(ctx context.Context, key string, n int64) (int64, error) {
+	defer mc.evict(key)
+
+	s := mc.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var cur int64
+	var expiresAt time.Time
+	if e := s.get(key, time.Now()); e != nil {
+		var err error
+		if cur, err = strconv.ParseInt(e.value, 10, 64); err != nil {
+			return 0, fmt.Errorf("incrementing %q: %w", key, ErrNotInteger)
+		}
+		expiresAt = e.expiresAt
+	}
+
+	cur += n
+	s.set(key, strconv.FormatInt(cur, 10), expiresAt)
+	return cur, nil
+}
+
+// Expire sets the time to live of key. Keys are deleted straight away when the
+// ttl isn't positive.
+func (mc *MemoryCache) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	s := mc.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.get(key, time.Now())
+	if e == nil {
+		return nil
+	}
+	if ttl <= 0 {
+		s.delete(key)
+		return nil
+	}
+	e.expiresAt = time.Now().Add(ttl)
+	return nil
+}
+
+// CompareAndSet sets key to value if its current value is old. An empty old
+// value matches a key that doesn't exist. A zero ttl keeps the key's current
+// expiry.
+func (mc *MemoryCache) CompareAndSet(ctx context.Context, key string, old string, value any, ttl time.Duration) (bool, error) {
+	v, err := encode(value)
+	if err != nil {
+		return false, err
+	}
+
+	defer mc.evict(key)
+
+	s := mc.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var cur string
+	var expiresAt time.Time
+	if e := s.get(key, now); e != nil {
+		cur, expiresAt = e.value, e.expiresAt
+	}
+	if cur != old {
+		return false, nil
+	}
+
+	if ttl > 0 {
+		expiresAt = now.Add(ttl)
+	}
+	s.set(key, v, expiresAt)
+	return true, nil
+}
+
+// DeleteValues removes the keys, ignoring the ones that don't exist.
+func (mc *MemoryCache) DeleteValues(ctx context.Context, keys ...string) error {
+	for _, key := range keys {
+		s := mc.shard(key)
+		s.mu.Lock()
+		s.delete(key)
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// shard returns the shard that holds key.
+func (mc *MemoryCache) shard(key string) *shard {
+	return mc.shards[mc.index(key)]
+}
+
+// index returns the position of the shard that holds key.
+func (mc *MemoryCache) index(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(mc.shards)))
+}
+
+// evict brings the store back to MaxKeys after key was written, dropping the
+// least recently used key of the shard of key first and of the following
+// shards after that. key itself is never evicted. It must be called without
+// any shard mutex held, as it locks the shards one at a time.
+func (mc *MemoryCache) evict(key string) {
+	if mc.maxKeys == 0 {
+		return
+	}
+
+	start := mc.index(key)
+	for i := 0; i < len(mc.shards) && mc.keys.Load() > int64(mc.maxKeys); i++ {
+		s := mc.shards[(start+i)%len(mc.shards)]
+		s.mu.Lock()
+		if oldest := s.lru.Back(); oldest != nil {
+			if e := oldest.Value.(*memoryEntry); e.key != key {
+				s.delete(e.key)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// janitor drops expired keys every interval until the store is closed.
+func (mc *MemoryCache) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-mc.stop:
+			return
+		case now := <-ticker.C:
+			for _, s := range mc.shards {
+				s.mu.Lock()
+				for key, el := range s.items {
+					if el.Value.(*memoryEntry).expired(now) {
+						s.delete(key)
+					}
+				}
+				s.mu.Unlock()
+			}
+		}
+	}
+}
+
+// get returns the live entry of key and marks it as recently used. Expired
+// entries are dropped. It must be called with the mutex held.
+func (s *shard) get(key string, now time.Time) *memoryEntry {
+	el, ok := s.items[key]
+	if !ok {
+		return nil
+	}
+
+	e := el.Value.(*memoryEntry)
+	if e.expired(now) {
+		s.delete(key)
+		return nil
+	}
+	s.lru.MoveToFront(el)
+	return e
+}
+
+// set stores the value of key. It must be called with the mutex held.
+func (s *shard) set(key string, value string, expiresAt time.Time) {
+	if el, ok := s.items[key]; ok {
+		e := el.Value.(*memoryEntry)
+		e.value, e.expiresAt = value, expiresAt
+		s.lru.MoveToFront(el)
+		return
+	}
+
+	s.items[key] = s.lru.PushFront(&memoryEntry{key: key, value: value, expiresAt: expiresAt})
+	s.keys.Add(1)
+}
+
+// delete removes key. It must be called with the mutex held.
+func (s *shard) delete(key string) {
+	if el, ok := s.items[key]; ok {
+		s.lru.Remove(el)
+		delete(s.items, key)
+		s.keys.Add(-1)
+	}
+}
+
+// expiry returns when a value stored now with ttl expires, or the zero time
+// when it doesn't.
+func expiry(now time.Time, ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return now.Add(ttl)
+}
+
+// encode converts a value to the string it is stored as, the same way the
+// redis client does.
+func encode(value any) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		if v {
+			return "1", nil
+		}
+		return "0", nil
+	case encoding.BinaryMarshaler:
+		b, err := v.MarshalBinary()
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+	return "", fmt.Errorf("can't store a value of type %T", value)
+}
+
+// The memory store only implements Store; the limiters fall back to
+// compare-and-set for everything else.
+var _ Store = (*MemoryCache)(nil)
@@ -0,0 +1,164 @@
+package cache_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Zanda256/rate-limiter-go/business/data/cache"
+)
+
+func TestMemoryCacheMaxKeys(t *testing.T) {
+	mc := cache.NewMemoryCache(cache.MemoryConfig{
+		Shards:  32,
+		MaxKeys: 10,
+	})
+	defer mc.Close()
+
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if _, err := mc.StoreValue(ctx, key, i, 0); err != nil {
+			t.Fatalf("storing %s: %s", key, err)
+		}
+
+		// The key just written is never the one evicted.
+		v, err := mc.RetrieveValue(ctx, key)
+		if err != nil {
+			t.Fatalf("retrieving %s: %s", key, err)
+		}
+		if v != fmt.Sprint(i) {
+			t.Fatalf("%s: got %v, want %d", key, v, i)
+		}
+	}
+
+	var kept int
+	for i := 0; i < 100; i++ {
+		v, err := mc.RetrieveValue(ctx, fmt.Sprintf("key-%d", i))
+		if err != nil {
+			t.Fatalf("retrieving key-%d: %s", i, err)
+		}
+		if v != nil {
+			kept++
+		}
+	}
+	if kept != 10 {
+		t.Errorf("got %d keys, want the 10 allowed by MaxKeys", kept)
+	}
+}
+
+func TestMemoryCacheExpiry(t *testing.T) {
+	mc := cache.NewMemoryCache(cache.MemoryConfig{})
+	defer mc.Close()
+
+	ctx := context.Background()
+	if _, err := mc.Increment(ctx, "counter", 2); err != nil {
+		t.Fatalf("incrementing: %s", err)
+	}
+	if err := mc.Expire(ctx, "counter", 20*time.Millisecond); err != nil {
+		t.Fatalf("expiring: %s", err)
+	}
+
+	n, err := mc.Increment(ctx, "counter", 3)
+	if err != nil {
+		t.Fatalf("incrementing: %s", err)
+	}
+	if n != 5 {
+		t.Fatalf("got %d, want 5", n)
+	}
+
+	time.Sleep(40 * time.Millisecond)
+
+	v, err := mc.RetrieveValue(ctx, "counter")
+	if err != nil {
+		t.Fatalf("retrieving: %s", err)
+	}
+	if v != nil {
+		t.Errorf("got %v after the ttl passed, want no value", v)
+	}
+}
+
+func TestMemoryCacheCompareAndSet(t *testing.T) {
+	mc := cache.NewMemoryCache(cache.MemoryConfig{})
+	defer mc.Close()
+
+	ctx := context.Background()
+	tests := []struct {
+		name  string
+		old   string
+		value string
+		want  bool
+	}{
+		{name: "absent", old: "", value: "a", want: true},
+		{name: "absent again", old: "", value: "b", want: false},
+		{name: "stale", old: "b", value: "c", want: false},
+		{name: "current", old: "a", value: "c", want: true},
+	}
+	for _, tt := range tests {
+		ok, err := mc.CompareAndSet(ctx, "key", tt.old, tt.value, time.Minute)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if ok != tt.want {
+			t.Errorf("%s: got %t, want %t", tt.name, ok, tt.want)
+		}
+	}
+
+	v, err := mc.RetrieveValue(ctx, "key")
+	if err != nil {
+		t.Fatalf("retrieving: %s", err)
+	}
+	if v != "c" {
+		t.Errorf("got %v, want c", v)
+	}
+}
+
+// racingStore is a store that another writer always changes between a read
+// and the compare-and-set that follows it.
+type racingStore struct {
+	*cache.MemoryCache
+	writes int
+}
+
+func (s *racingStore) CompareAndSet(ctx context.Context, key string, old string, value any, ttl time.Duration) (bool, error) {
+	s.writes++
+	if _, err := s.MemoryCache.StoreValue(ctx, key, s.writes, 0); err != nil {
+		return false, err
+	}
+	return s.MemoryCache.CompareAndSet(ctx, key, old, value, ttl)
+}
+
+func TestUpdate(t *testing.T) {
+	mc := cache.NewMemoryCache(cache.MemoryConfig{})
+	defer mc.Close()
+
+	ctx := context.Background()
+	incr := func(cur string, found bool) (string, bool, error) {
+		return cur + "x", true, nil
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := cache.Update(ctx, mc, "key", time.Minute, incr); err != nil {
+			t.Fatalf("update %d: %s", i+1, err)
+		}
+	}
+	v, err := mc.RetrieveValue(ctx, "key")
+	if err != nil {
+		t.Fatalf("retrieving: %s", err)
+	}
+	if v != "xxx" {
+		t.Errorf("got %v, want xxx", v)
+	}
+
+	// Updates that keep losing the race give up.
+	store := racingStore{MemoryCache: mc}
+	err = cache.Update(ctx, &store, "key", time.Minute, incr)
+	if !errors.Is(err, cache.ErrContended) {
+		t.Fatalf("got %v, want ErrContended", err)
+	}
+	if store.writes < 2 {
+		t.Errorf("got %d attempts, want the update retried", store.writes)
+	}
+}
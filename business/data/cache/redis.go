@@ -2,9 +2,12 @@ package cache
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
-	"log"
+	"os"
+	"strconv"
 	"time"
 
 	redis "github.com/redis/go-redis/v9"
@@ -12,26 +15,144 @@ import (
 
 var ErrKeyNotFound = errors.New("key not found")
 
+// Deployment modes of redis.
+const (
+	RedisStandalone = "standalone"
+	RedisSentinel   = "sentinel"
+	RedisCluster    = "cluster"
+)
+
+// RedisConfig declares how to connect to redis. Addrs holds the address of
+// the server in standalone mode, of the sentinels in sentinel mode and of
+// some of the nodes in cluster mode. Timeouts are in milliseconds. Settings
+// that aren't configured get the defaults of the redis client.
+type RedisConfig struct {
+	Mode             string          `json:"mode,omitempty"`
+	Addrs            []string        `json:"addrs,omitempty"`
+	MasterName       string          `json:"masterName,omitempty"`
+	Username         string          `json:"username,omitempty"`
+	Password         string          `json:"password,omitempty"`
+	SentinelUsername string          `json:"sentinelUsername,omitempty"`
+	SentinelPassword string          `json:"sentinelPassword,omitempty"`
+	DB               int             `json:"db,omitempty"`
+	TLS              *RedisTLSConfig `json:"tls,omitempty"`
+	PoolSize         int             `json:"poolSize,omitempty"`
+	MinIdleConns     int             `json:"minIdleConns,omitempty"`
+	MaxIdleConns     int             `json:"maxIdleConns,omitempty"`
+	DialTimeout      int             `json:"dialTimeout,omitempty"`
+	ReadTimeout      int             `json:"readTimeout,omitempty"`
+	WriteTimeout     int             `json:"writeTimeout,omitempty"`
+	PoolTimeout      int             `json:"poolTimeout,omitempty"`
+}
+
+// RedisTLSConfig enables TLS. The server is verified against CAFile, or the
+// system roots when it's empty. CertFile and KeyFile hold the client
+// certificate for servers that require one.
+type RedisTLSConfig struct {
+	CAFile             string `json:"caFile,omitempty"`
+	CertFile           string `json:"certFile,omitempty"`
+	KeyFile            string `json:"keyFile,omitempty"`
+	ServerName         string `json:"serverName,omitempty"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty"`
+}
+
 type RedisCache struct {
-	client *redis.Client
+	client redis.UniversalClient
 }
 
-func NewRedisCache(redisAddress string) *RedisCache {
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     redisAddress, //"localhost:6379",
-		Password: "",           // no password set
-		DB:       0,            // use default DB
-	})
+// NewRedisCache connects to redis and checks that it answers. Multi-key
+// operations only work in cluster mode when all of their keys hash to the
+// same slot, so keys touched together share a hash tag.
+func NewRedisCache(cfg RedisConfig) (*RedisCache, error) {
+	opts := redis.UniversalOptions{
+		Addrs:            cfg.Addrs,
+		MasterName:       cfg.MasterName,
+		Username:         cfg.Username,
+		Password:         cfg.Password,
+		SentinelUsername: cfg.SentinelUsername,
+		SentinelPassword: cfg.SentinelPassword,
+		DB:               cfg.DB,
+		PoolSize:         cfg.PoolSize,
+		MinIdleConns:     cfg.MinIdleConns,
+		MaxIdleConns:     cfg.MaxIdleConns,
+		DialTimeout:      time.Duration(cfg.DialTimeout) * time.Millisecond,
+		ReadTimeout:      time.Duration(cfg.ReadTimeout) * time.Millisecond,
+		WriteTimeout:     time.Duration(cfg.WriteTimeout) * time.Millisecond,
+		PoolTimeout:      time.Duration(cfg.PoolTimeout) * time.Millisecond,
+	}
 
-	status, err := rdb.Ping(context.Background()).Result()
-	if err != nil {
-		log.Fatalln("Redis connection was refused")
+	if cfg.TLS != nil {
+		tlsCfg, err := cfg.TLS.config()
+		if err != nil {
+			return nil, fmt.Errorf("configuring tls: %w", err)
+		}
+		opts.TLSConfig = tlsCfg
+	}
+
+	// The mode is picked explicitly rather than guessed from the options, so
+	// that a cluster can be reached through a single node.
+	var rdb redis.UniversalClient
+	switch cfg.Mode {
+	case "", RedisStandalone:
+		rdb = redis.NewClient(opts.Simple())
+	case RedisSentinel:
+		if cfg.MasterName == "" {
+			return nil, errors.New("sentinel mode needs the name of the master")
+		}
+		rdb = redis.NewFailoverClient(opts.Failover())
+	case RedisCluster:
+		if cfg.DB != 0 {
+			return nil, errors.New("cluster mode only supports db 0")
+		}
+		rdb = redis.NewClusterClient(opts.Cluster())
+	default:
+		return nil, fmt.Errorf("unknown redis mode %q", cfg.Mode)
+	}
+
+	if err := rdb.Ping(context.Background()).Err(); err != nil {
+		rdb.Close()
+		return nil, fmt.Errorf("connecting to redis: %w", err)
 	}
-	fmt.Println(status)
 
 	return &RedisCache{
 		client: rdb,
+	}, nil
+}
+
+// Close closes the connections to redis.
+func (rc *RedisCache) Close() error {
+	return rc.client.Close()
+}
+
+// config builds the TLS configuration, loading the certificates from disk.
+func (c *RedisTLSConfig) config() (*tls.Config, error) {
+	tlsCfg := tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading ca file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %q", c.CAFile)
+		}
+		tlsCfg.RootCAs = pool
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
 	}
+
+	return &tlsCfg, nil
 }
 
 func (rc *RedisCache) StoreValue(ctx context.Context, key string, value any, ttl int) (any, error) {
@@ -51,3 +172,126 @@ func (rc *RedisCache) RetrieveValue(ctx context.Context, key string) (any, error
 	}
 	return val, nil
 }
+
+// Increment adds n to the integer stored at key, creating it at zero first if
+// needed, and returns the result.
+func (rc *RedisCache) Increment(ctx context.Context, key string, n int64) (int64, error) {
+	return rc.client.IncrBy(ctx, key, n).Result()
+}
+
+// Expire sets the time to live of key.
+func (rc *RedisCache) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	return rc.client.PExpire(ctx, key, ttl).Err()
+}
+
+// compareAndSetScript sets KEYS[1] to ARGV[2] if its value is ARGV[1], or if
+// it doesn't exist when ARGV[1] is empty. ARGV[3] is the ttl in milliseconds,
+// zero keeps the current one.
+var compareAndSetScript = NewScript(`
+local cur = redis.call("GET", KEYS[1])
+if cur == false then
+	cur = ""
+end
+if cur ~= ARGV[1] then
+	return 0
+end
+
+if tonumber(ARGV[3]) > 0 then
+	redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+else
+	redis.call("SET", KEYS[1], ARGV[2], "KEEPTTL")
+end
+return 1
+`)
+
+// CompareAndSet sets key to value if its current value is old. An empty old
+// value matches a key that doesn't exist. A zero ttl keeps the key's current
+// expiry.
+func (rc *RedisCache) CompareAndSet(ctx context.Context, key string, old string, value any, ttl time.Duration) (bool, error) {
+	res, err := rc.RunScript(ctx, compareAndSetScript, []string{key}, old, value, ttl.Milliseconds())
+	if err != nil {
+		return false, err
+	}
+	return res == int64(1), nil
+}
+
+// DeleteValues removes the keys, ignoring the ones that don't exist. In
+// cluster mode the keys must share a hash slot.
+func (rc *RedisCache) DeleteValues(ctx context.Context, keys ...string) error {
+	return rc.client.Del(ctx, keys...).Err()
+}
+
+// RetrieveHashField returns the value of field in the hash stored at key. It
+// returns ErrKeyNotFound when either the hash or the field doesn't exist.
+func (rc *RedisCache) RetrieveHashField(ctx context.Context, key string, field string) (string, error) {
+	val, err := rc.client.HGet(ctx, key, field).Result()
+	if err == redis.Nil {
+		return "", ErrKeyNotFound
+	} else if err != nil {
+		return "", err
+	}
+	return val, nil
+}
+
+// AppendToLog adds members to the sorted set stored at key with the given
+// score, after dropping every entry scored below minScore. The whole operation
+// runs in a single MULTI/EXEC transaction and returns the number of entries in
+// the log, including the new members, along with the score of the oldest one.
+func (rc *RedisCache) AppendToLog(ctx context.Context, key string, score, minScore int64, ttl time.Duration, members ...string) (int64, int64, error) {
+	zs := make([]redis.Z, len(members))
+	for i, m := range members {
+		zs[i] = redis.Z{Score: float64(score), Member: m}
+	}
+
+	pipe := rc.client.TxPipeline()
+	pipe.ZRemRangeByScore(ctx, key, "-inf", "("+strconv.FormatInt(minScore, 10))
+	pipe.ZAdd(ctx, key, zs...)
+	card := pipe.ZCard(ctx, key)
+	oldest := pipe.ZRangeWithScores(ctx, key, 0, 0)
+	pipe.Expire(ctx, key, ttl)
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, 0, err
+	}
+
+	var oldestScore int64
+	if zs := oldest.Val(); len(zs) > 0 {
+		oldestScore = int64(zs[0].Score)
+	}
+	return card.Val(), oldestScore, nil
+}
+
+// RemoveFromLog removes members from the sorted set stored at key.
+func (rc *RedisCache) RemoveFromLog(ctx context.Context, key string, members ...string) error {
+	vals := make([]any, len(members))
+	for i, m := range members {
+		vals[i] = m
+	}
+	return rc.client.ZRem(ctx, key, vals...).Err()
+}
+
+// Script is a Lua script that is run atomically on the redis server.
+type Script struct {
+	script *redis.Script
+}
+
+// NewScript wraps the Lua source so that it can be run with RunScript.
+func NewScript(src string) *Script {
+	return &Script{
+		script: redis.NewScript(src),
+	}
+}
+
+// RunScript runs the script with EVALSHA, falling back to EVAL when the
+// server doesn't have the script cached yet.
+func (rc *RedisCache) RunScript(ctx context.Context, s *Script, keys []string, args ...any) (any, error) {
+	return s.script.Run(ctx, rc.client, keys, args...).Result()
+}
+
+// Interfaces the redis store implements.
+var (
+	_ Store        = (*RedisCache)(nil)
+	_ ScriptRunner = (*RedisCache)(nil)
+	_ LogStore     = (*RedisCache)(nil)
+	_ HashStore    = (*RedisCache)(nil)
+)
@@ -0,0 +1,147 @@
+package cache_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Zanda256/rate-limiter-go/business/data/cache"
+	"github.com/alicebob/miniredis/v2"
+)
+
+// store is a store under test along with a way to move its clock forward.
+type store struct {
+	name    string
+	store   cache.Store
+	advance func(d time.Duration)
+}
+
+// newStores returns a redis store, which runs the scripts, and a memory
+// store, which runs the compare-and-set fallbacks of the same operations.
+func newStores(t *testing.T) []store {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	rc, err := cache.NewRedisCache(cache.RedisConfig{Addrs: []string{mr.Addr()}})
+	if err != nil {
+		t.Fatalf("connecting to redis: %s", err)
+	}
+	t.Cleanup(func() { rc.Close() })
+
+	mc := cache.NewMemoryCache(cache.MemoryConfig{})
+	t.Cleanup(mc.Close)
+
+	return []store{
+		{name: "redis", store: rc, advance: mr.FastForward},
+		{name: "memory", store: mc, advance: time.Sleep},
+	}
+}
+
+func TestCompareAndSetExpiry(t *testing.T) {
+	for _, s := range newStores(t) {
+		t.Run(s.name, func(t *testing.T) {
+			ctx := context.Background()
+
+			ok, err := s.store.CompareAndSet(ctx, "key", "", "a", 50*time.Millisecond)
+			if err != nil || !ok {
+				t.Fatalf("setting: got %t, %v", ok, err)
+			}
+
+			// A zero ttl keeps the expiry the key already has.
+			ok, err = s.store.CompareAndSet(ctx, "key", "a", "b", 0)
+			if err != nil || !ok {
+				t.Fatalf("replacing: got %t, %v", ok, err)
+			}
+			v, err := s.store.RetrieveValue(ctx, "key")
+			if err != nil || v != "b" {
+				t.Fatalf("got %v, %v, want b", v, err)
+			}
+
+			s.advance(100 * time.Millisecond)
+
+			v, err = s.store.RetrieveValue(ctx, "key")
+			if err != nil || v != nil {
+				t.Errorf("got %v, %v after the ttl passed, want no value", v, err)
+			}
+		})
+	}
+}
+
+func TestDecrement(t *testing.T) {
+	for _, s := range newStores(t) {
+		t.Run(s.name, func(t *testing.T) {
+			ctx := context.Background()
+
+			if _, err := s.store.Increment(ctx, "a", 5); err != nil {
+				t.Fatalf("incrementing: %s", err)
+			}
+			if _, err := s.store.Increment(ctx, "b", 1); err != nil {
+				t.Fatalf("incrementing: %s", err)
+			}
+			if err := s.store.Expire(ctx, "a", 50*time.Millisecond); err != nil {
+				t.Fatalf("expiring: %s", err)
+			}
+
+			if err := cache.Decrement(ctx, s.store, 2, "a", "b", "missing"); err != nil {
+				t.Fatalf("decrementing: %s", err)
+			}
+
+			// Counters never go below zero and missing ones aren't created.
+			want := map[string]any{"a": "3", "b": "0", "missing": nil}
+			for key, w := range want {
+				v, err := s.store.RetrieveValue(ctx, key)
+				if err != nil {
+					t.Fatalf("retrieving %s: %s", key, err)
+				}
+				if v != w {
+					t.Errorf("%s: got %v, want %v", key, v, w)
+				}
+			}
+
+			// The expiry is kept.
+			s.advance(100 * time.Millisecond)
+			if v, err := s.store.RetrieveValue(ctx, "a"); err != nil || v != nil {
+				t.Errorf("got %v, %v after the ttl passed, want no value", v, err)
+			}
+		})
+	}
+}
+
+func TestLog(t *testing.T) {
+	for _, s := range newStores(t) {
+		t.Run(s.name, func(t *testing.T) {
+			ctx := context.Background()
+
+			steps := []struct {
+				score, minScore int64
+				members         []string
+				count, oldest   int64
+			}{
+				{score: 10, minScore: 0, members: []string{"a", "b"}, count: 2, oldest: 10},
+				{score: 20, minScore: 0, members: []string{"c"}, count: 3, oldest: 10},
+				// Entries scored below minScore are dropped first.
+				{score: 30, minScore: 15, members: []string{"d"}, count: 2, oldest: 20},
+			}
+			for i, st := range steps {
+				count, oldest, err := cache.AppendToLog(ctx, s.store, "log", st.score, st.minScore, time.Minute, st.members...)
+				if err != nil {
+					t.Fatalf("step %d: %s", i+1, err)
+				}
+				if count != st.count || oldest != st.oldest {
+					t.Errorf("step %d: got %d entries from %d, want %d from %d", i+1, count, oldest, st.count, st.oldest)
+				}
+			}
+
+			if err := cache.RemoveFromLog(ctx, s.store, "log", "c"); err != nil {
+				t.Fatalf("removing: %s", err)
+			}
+			count, oldest, err := cache.AppendToLog(ctx, s.store, "log", 40, 0, time.Minute, "e")
+			if err != nil {
+				t.Fatalf("appending: %s", err)
+			}
+			if count != 2 || oldest != 30 {
+				t.Errorf("after removing: got %d entries from %d, want 2 from 30", count, oldest)
+			}
+		})
+	}
+}
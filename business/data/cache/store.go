@@ -0,0 +1,229 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// maxUpdateAttempts bounds how many times Update retries a compare-and-set
+// that lost a race against another writer.
+const maxUpdateAttempts = 64
+
+// ErrContended is returned by Update when the key kept changing under it.
+var ErrContended = errors.New("too much contention on key")
+
+// Store is the storage the rate limiters keep their state in. Values can be
+// strings, byte slices, numbers or anything that implements
+// encoding.BinaryMarshaler; RetrieveValue returns them as strings, or nil when
+// the key doesn't exist. StoreValue takes its ttl in minutes. CompareAndSet
+// only sets the value when the current one equals old, or when the key doesn't
+// exist if old is empty; a zero ttl keeps the key's current expiry.
+type Store interface {
+	StoreValue(ctx context.Context, key string, value any, ttl int) (any, error)
+	RetrieveValue(ctx context.Context, key string) (any, error)
+	Increment(ctx context.Context, key string, n int64) (int64, error)
+	Expire(ctx context.Context, key string, ttl time.Duration) error
+	CompareAndSet(ctx context.Context, key string, old string, value any, ttl time.Duration) (bool, error)
+	DeleteValues(ctx context.Context, keys ...string) error
+}
+
+// ScriptRunner is implemented by stores that can run Lua scripts atomically.
+// Limiters use scripts when the store supports them and fall back to Update
+// otherwise.
+type ScriptRunner interface {
+	RunScript(ctx context.Context, s *Script, keys []string, args ...any) (any, error)
+}
+
+// LogStore is implemented by stores with native sorted sets.
+type LogStore interface {
+	AppendToLog(ctx context.Context, key string, score, minScore int64, ttl time.Duration, members ...string) (int64, int64, error)
+	RemoveFromLog(ctx context.Context, key string, members ...string) error
+}
+
+// HashStore is implemented by stores with native hashes.
+type HashStore interface {
+	RetrieveHashField(ctx context.Context, key string, field string) (string, error)
+}
+
+// Update replaces the value of key with the one fn computes from the current
+// value, retrying whenever another writer changed the value in between. fn is
+// called with found set to false when the key doesn't exist, and returns
+// write set to false to leave the value alone. fn may be called several
+// times, so it must not have side effects other than on the variables it
+// reports its result through.
+//
+// Limiters check and change their state in one step: with a script when the
+// store is a ScriptRunner, and with the same steps through Update otherwise.
+// Keys a script touches together share a hash tag, so that they live in the
+// same slot of a redis cluster.
+func Update(ctx context.Context, s Store, key string, ttl time.Duration, fn func(cur string, found bool) (next string, write bool, err error)) error {
+	for i := 0; i < maxUpdateAttempts; i++ {
+		v, err := s.RetrieveValue(ctx, key)
+		if err != nil {
+			return err
+		}
+
+		var cur string
+		if v != nil {
+			if cur, err = asString(v); err != nil {
+				return err
+			}
+		}
+
+		next, write, err := fn(cur, v != nil)
+		if err != nil || !write {
+			return err
+		}
+
+		ok, err := s.CompareAndSet(ctx, key, cur, next, ttl)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("updating %q: %w", key, ErrContended)
+}
+
+// UpdateJSON is Update for values stored as JSON. v is reset to the current
+// value, or left at its zero value when the key doesn't exist, before fn is
+// called to change it.
+func UpdateJSON[T any](ctx context.Context, s Store, key string, ttl time.Duration, v *T, fn func(v *T) (write bool, err error)) error {
+	return Update(ctx, s, key, ttl, func(cur string, found bool) (string, bool, error) {
+		var zero T
+		*v = zero
+		if found {
+			if err := json.Unmarshal([]byte(cur), v); err != nil {
+				return "", false, fmt.Errorf("unmarshal %q: %w", key, err)
+			}
+		}
+
+		write, err := fn(v)
+		if err != nil || !write {
+			return "", false, err
+		}
+
+		next, err := json.Marshal(v)
+		if err != nil {
+			return "", false, err
+		}
+		return string(next), true, nil
+	})
+}
+
+// decrementScript takes up to ARGV[1] from each of the counters at KEYS, never
+// going below zero. Missing counters are left alone and DECRBY keeps the
+// expiry of the others.
+var decrementScript = NewScript(`
+local n = tonumber(ARGV[1])
+for i = 1, #KEYS do
+	local cur = tonumber(redis.call("GET", KEYS[i]) or "0")
+	if cur > 0 then
+		redis.call("DECRBY", KEYS[i], math.min(cur, n))
+	end
+end
+return 0
+`)
+
+// Decrement takes up to n from each of the integers stored at keys, never
+// going below zero, for limiters giving back units they counted. Missing keys
+// are left alone and expiries are kept. Stores that can run scripts update
+// all the keys at once, so they must share a hash tag in a redis cluster.
+func Decrement(ctx context.Context, s Store, n int64, keys ...string) error {
+	if sr, ok := s.(ScriptRunner); ok {
+		_, err := sr.RunScript(ctx, decrementScript, keys, n)
+		return err
+	}
+
+	for _, key := range keys {
+		err := Update(ctx, s, key, 0, func(cur string, found bool) (string, bool, error) {
+			if !found {
+				return "", false, nil
+			}
+			v, err := strconv.ParseInt(cur, 10, 64)
+			if err != nil {
+				return "", false, fmt.Errorf("decrementing %q: %w", key, ErrNotInteger)
+			}
+			if v <= 0 {
+				return "", false, nil
+			}
+			return strconv.FormatInt(max(0, v-n), 10), true, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type logEntry struct {
+	Member string `json:"m"`
+	Score  int64  `json:"s"`
+}
+
+// AppendToLog adds members to the sorted log stored at key, see
+// RedisCache.AppendToLog. Stores without sorted sets keep the log as a single
+// JSON value.
+func AppendToLog(ctx context.Context, s Store, key string, score, minScore int64, ttl time.Duration, members ...string) (int64, int64, error) {
+	if ls, ok := s.(LogStore); ok {
+		return ls.AppendToLog(ctx, key, score, minScore, ttl, members...)
+	}
+
+	var count, oldest int64
+	var log []logEntry
+	err := UpdateJSON(ctx, s, key, ttl, &log, func(log *[]logEntry) (bool, error) {
+		kept := make([]logEntry, 0, len(*log)+len(members))
+		for _, e := range *log {
+			if e.Score >= minScore {
+				kept = append(kept, e)
+			}
+		}
+		for _, m := range members {
+			kept = append(kept, logEntry{Member: m, Score: score})
+		}
+		*log = kept
+
+		count = int64(len(kept))
+		oldest = 0
+		for i, e := range kept {
+			if i == 0 || e.Score < oldest {
+				oldest = e.Score
+			}
+		}
+		return true, nil
+	})
+	return count, oldest, err
+}
+
+// RemoveFromLog removes members from the sorted log stored at key.
+func RemoveFromLog(ctx context.Context, s Store, key string, members ...string) error {
+	if ls, ok := s.(LogStore); ok {
+		return ls.RemoveFromLog(ctx, key, members...)
+	}
+
+	var log []logEntry
+	return UpdateJSON(ctx, s, key, 0, &log, func(log *[]logEntry) (bool, error) {
+		n := len(*log)
+		*log = slices.DeleteFunc(*log, func(e logEntry) bool {
+			return slices.Contains(members, e.Member)
+		})
+		return len(*log) != n, nil
+	})
+}
+
+// asString converts a value returned by RetrieveValue to a string.
+func asString(v any) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	}
+	return "", fmt.Errorf("unexpected value of type %T", v)
+}
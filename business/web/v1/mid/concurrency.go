@@ -0,0 +1,49 @@
+package mid
+
+import (
+	"context"
+	"net/http"
+
+	ratelimiter "github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter"
+	"github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter/concurrency"
+	"github.com/Zanda256/rate-limiter-go/foundation/logger"
+	"github.com/Zanda256/rate-limiter-go/foundation/web"
+)
+
+// ConcurrencyConfig contains what the Concurrency middleware needs. OnFailure
+// decides how requests whose slots can't be counted are treated: they fail
+// unless it is ratelimiter.FailOpen, in which case they go ahead without a
+// slot.
+type ConcurrencyConfig struct {
+	Log       *logger.Logger
+	Limiter   *concurrency.Limiter
+	OnFailure string
+}
+
+// Concurrency rejects requests from callers that already have the maximum
+// number of requests in flight. The slot is released when the handler
+// returns, including when it panics.
+func Concurrency(cfg ConcurrencyConfig) web.Middleware {
+	f := func(h web.Handler) web.Handler {
+		m := func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			user := r.URL.Query().Get("user")
+
+			release, ok, err := cfg.Limiter.Acquire(user)
+			switch {
+			case err != nil:
+				if cfg.OnFailure != ratelimiter.FailOpen {
+					return err
+				}
+				cfg.Log.Warn(ctx, "requests in flight couldn't be counted", "user", user, "msg", err)
+				return h(ctx, w, r)
+			case !ok:
+				return ratelimiter.NewRateLimitError("too many requests in flight")
+			}
+			defer release()
+
+			return h(ctx, w, r)
+		}
+		return m
+	}
+	return f
+}
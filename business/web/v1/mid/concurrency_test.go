@@ -0,0 +1,58 @@
+package mid_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Zanda256/rate-limiter-go/business/web/v1/mid"
+	ratelimiter "github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter"
+	"github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter/concurrency"
+)
+
+func TestConcurrencyStoreFailure(t *testing.T) {
+	tests := []struct {
+		onFailure string
+		wantErr   bool
+	}{
+		{onFailure: ratelimiter.FailClosed, wantErr: true},
+		{onFailure: ratelimiter.FailOpen},
+	}
+	for _, tt := range tests {
+		t.Run(tt.onFailure, func(t *testing.T) {
+			log := newLogger()
+			cl := concurrency.NewLimiter(concurrency.LimiterConfig{
+				Log:         log,
+				Store:       brokenStore{},
+				MaxInFlight: 1,
+			})
+
+			var served bool
+			h := mid.Concurrency(mid.ConcurrencyConfig{
+				Log:       log,
+				Limiter:   cl,
+				OnFailure: tt.onFailure,
+			})(func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+				served = true
+				return nil
+			})
+
+			r := httptest.NewRequest(http.MethodGet, "/v1/limited?user=alice", nil)
+			err := h(context.Background(), httptest.NewRecorder(), r)
+			if tt.wantErr {
+				if !errors.Is(err, errUnreachable) {
+					t.Fatalf("got %v, want the store error", err)
+				}
+				if served {
+					t.Errorf("the handler ran without a slot")
+				}
+				return
+			}
+			if err != nil || !served {
+				t.Fatalf("got %v, want the request served", err)
+			}
+		})
+	}
+}
@@ -29,6 +29,13 @@ func Errors(log *logger.Logger) web.Middleware {
 					}
 					status = http.StatusTooManyRequests
 
+				case response.IsError(err):
+					reqErr := response.GetError(err)
+					er = response.ErrorDocument{
+						Error: reqErr.Error(),
+					}
+					status = reqErr.Status
+
 				default:
 					er = response.ErrorDocument{
 						Error: http.StatusText(http.StatusInternalServerError),
@@ -0,0 +1,30 @@
+package mid
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+
+	"github.com/Zanda256/rate-limiter-go/business/web/v1/response"
+	"github.com/Zanda256/rate-limiter-go/foundation/web"
+)
+
+// Operator restricts a route to operators, who authenticate with the bearer
+// token provided.
+func Operator(token string) web.Middleware {
+	want := []byte("Bearer " + token)
+
+	f := func(h web.Handler) web.Handler {
+		m := func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			got := []byte(r.Header.Get("Authorization"))
+			if subtle.ConstantTimeCompare(got, want) != 1 {
+				return response.NewError(errors.New("operator token required"), http.StatusUnauthorized)
+			}
+
+			return h(ctx, w, r)
+		}
+		return m
+	}
+	return f
+}
@@ -2,26 +2,261 @@ package mid
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
 	ratelimiter "github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter"
+	"github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter/penalty"
+	"github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter/priority"
+	"github.com/Zanda256/rate-limiter-go/business/web/v1/response"
+	"github.com/Zanda256/rate-limiter-go/foundation/logger"
 	"github.com/Zanda256/rate-limiter-go/foundation/web"
 )
 
-// TODO: take in limiter config
-func RateLimit(rlmt *ratelimiter.RateLimiterImpl) web.Middleware {
+// CostFunc computes how many units of the caller's limit a request consumes.
+type CostFunc func(r *http.Request) int
+
+// FixedCost returns a CostFunc that charges n units for every request.
+func FixedCost(n int) CostFunc {
+	return func(r *http.Request) int {
+		return n
+	}
+}
+
+// RateLimitConfig contains what the RateLimit middleware needs to enforce
+// per tier limits. Requests cost a single unit unless a Cost is provided.
+// When a Hierarchy is provided, the limits of the caller's owners are enforced
+// after the caller's own. When a Shedder is provided, requests that passed
+// their limits are shed by priority once the service wide budget runs low.
+// The priority class comes from the shedder's header, then from Priority.
+// When a Global limit is provided, it is enforced after the caller's own
+// limits; callers denied by it aren't penalised, and get back the units their
+// own limits consumed. When a Jail is provided, callers that keep exceeding
+// their limits are banned, and banned callers are turned away before any limit
+// is checked. Requests whose limits would queue them for longer than MaxDelay
+// are turned away; it should stay below the server's write timeout, so that
+// queued requests are still answered. A zero MaxDelay doesn't bound the delay.
+type RateLimitConfig struct {
+	Log       *logger.Logger
+	Limiter   *ratelimiter.TieredLimiter
+	Hierarchy *ratelimiter.Hierarchy
+	Global    *ratelimiter.GlobalLimit
+	Shedder   *priority.Shedder
+	Jail      *penalty.Jail
+	Priority  string
+	Cost      CostFunc
+	MaxDelay  time.Duration
+}
+
+// RateLimit rejects requests from callers that have exceeded the limits of
+// their tier. Callers are identified by the user query parameter. The state
+// of the caller's limit is returned in the RateLimit-* headers. Limits, bans
+// and owners that can't be checked are treated according to the failure mode
+// of the tier they belong to, the caller's own for bans. Requests whose limits
+// queue them are held until their delay is over, or until they are cancelled.
+// A request turned away by one check gets back the units the checks before it
+// consumed, so callers are only charged for requests that reach the handler.
+// Limiters that implement ratelimiter.Observer are told the latency and status
+// code of every request that did.
+func RateLimit(cfg RateLimitConfig) web.Middleware {
 	f := func(h web.Handler) web.Handler {
 		m := func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
-			// Do what ever you want with the request here
-			q := r.URL.Query()
-			user := q.Get("user")
-			if !rlmt.CheckUserLimit(user) {
-				return ratelimiter.NewRateLimitError("limit exceeded") //errors.New("limit exceeded")
-			}
-			// Call h()
-			return h(ctx, w, r)
+			user := r.URL.Query().Get("user")
+
+			tier, rl, err := cfg.Limiter.Limiter(ctx, r, user)
+			if err != nil {
+				return err
+			}
+
+			if cfg.Jail != nil {
+				until, err := cfg.Jail.BannedUntil(ctx, user)
+				switch {
+				case err != nil:
+					if !rl.TolerateFailure() {
+						return err
+					}
+					cfg.Log.Warn(ctx, "ban couldn't be checked", "user", user, "onFailure", rl.OnFailure, "msg", err)
+				case !until.IsZero():
+					w.Header().Set("Retry-After", strconv.Itoa(seconds(time.Until(until))))
+					return ratelimiter.NewRateLimitError("banned until %s", until.Format(time.RFC3339))
+				}
+			}
+
+			cost := 1
+			if cfg.Cost != nil {
+				if cost = cfg.Cost(r); cost < 1 {
+					cost = 1
+				}
+			}
+
+			// Once the handler runs the units are spent. Until then, every way
+			// out gives back what the checks passed so far consumed.
+			var refunds ratelimiter.Refunds
+			var handled bool
+			defer func() {
+				if handled {
+					return
+				}
+				if err := refunds.Refund(); err != nil {
+					cfg.Log.Error(ctx, "giving back units of a rejected request", "user", user, "msg", err)
+				}
+			}()
+
+			d, refund := rl.Admit(user, cost)
+			if d.Err != nil {
+				return fmt.Errorf("checking %s limit: %w", d.Policy, d.Err)
+			}
+			setLimitHeaders(w, d)
+			if !d.Allowed {
+				return deny(ctx, w, cfg, rl, user, d)
+			}
+			refunds.Add(refund)
+			delay := d.Delay
+
+			if cfg.Hierarchy != nil {
+				d, refund := cfg.Hierarchy.Check(ctx, r, user, cost)
+				if d.Err != nil {
+					return d.Err
+				}
+				if !d.Allowed {
+					setLimitHeaders(w, d)
+					return deny(ctx, w, cfg, rl, user, d)
+				}
+				refunds.Add(refund)
+				delay = max(delay, d.Delay)
+			}
+
+			if cfg.Global != nil {
+				d, refund := cfg.Global.Check(user, tier, cost)
+				if d.Err != nil {
+					return d.Err
+				}
+				if !d.Allowed {
+					setLimitHeaders(w, d)
+					return ratelimiter.NewRateLimitError("%s limit exceeded", d.Policy)
+				}
+				refunds.Add(refund)
+				delay = max(delay, d.Delay)
+			}
+
+			if cfg.MaxDelay > 0 && delay > cfg.MaxDelay {
+				w.Header().Set("Retry-After", strconv.Itoa(seconds(delay)))
+				return ratelimiter.NewRateLimitError("request would be queued for longer than %s", cfg.MaxDelay)
+			}
+
+			if cfg.Shedder != nil {
+				class := cfg.Priority
+				if cfg.Shedder.Header != "" {
+					if v := r.Header.Get(cfg.Shedder.Header); v != "" {
+						class = v
+					}
+				}
+				ok, err := cfg.Shedder.Accept(class, cost)
+				switch {
+				case err != nil:
+					if !rl.TolerateFailure() {
+						return err
+					}
+					cfg.Log.Warn(ctx, "load couldn't be checked", "class", class, "onFailure", rl.OnFailure, "msg", err)
+				case !ok:
+					return response.NewError(errors.New("service overloaded"), http.StatusServiceUnavailable)
+				default:
+					refunds.Add(func() error {
+						return cfg.Shedder.Refund(class, cost)
+					})
+				}
+			}
+
+			if err := ratelimiter.Sleep(ctx, delay); err != nil {
+				return err
+			}
+
+			handled = true
+
+			obs, ok := rl.Limiter.(ratelimiter.Observer)
+			if !ok {
+				return h(ctx, w, r)
+			}
+
+			// Report a panicking handler as a server error.
+			start := time.Now()
+			status := http.StatusInternalServerError
+			defer func() {
+				obs.Observe(user, time.Since(start), status)
+			}()
+
+			err = h(ctx, w, r)
+			status = statusCode(ctx, err)
+
+			return err
 		}
 		return m
 	}
 	return f
 }
+
+// deny rejects a request that exceeded a limit. The denial counts towards a
+// ban when a jail is provided; the denial that triggers it tells the caller to
+// retry once the ban is over. A denial that can't be recorded is treated
+// according to the failure mode of the caller's tier.
+func deny(ctx context.Context, w http.ResponseWriter, cfg RateLimitConfig, rl *ratelimiter.RateLimiterImpl, user string, d ratelimiter.Decision) error {
+	if cfg.Jail != nil {
+		until, err := cfg.Jail.RecordDenial(ctx, user)
+		switch {
+		case err != nil:
+			if !rl.TolerateFailure() {
+				return err
+			}
+			cfg.Log.Warn(ctx, "denial couldn't be recorded", "user", user, "onFailure", rl.OnFailure, "msg", err)
+		case !until.IsZero():
+			w.Header().Set("Retry-After", strconv.Itoa(seconds(time.Until(until))))
+		}
+	}
+	return ratelimiter.NewRateLimitError("%s limit exceeded", d.Policy)
+}
+
+// setLimitHeaders describes the limit a decision was made against in the
+// RateLimit-* response headers, and tells denied callers when to retry.
+// Decisions without a limit, like those of a tier that failed open, only
+// report their policy.
+func setLimitHeaders(w http.ResponseWriter, d ratelimiter.Decision) {
+	h := w.Header()
+	if d.Limit > 0 {
+		h.Set("RateLimit-Limit", strconv.Itoa(d.Limit))
+		h.Set("RateLimit-Remaining", strconv.Itoa(max(0, d.Remaining)))
+		if !d.ResetAt.IsZero() {
+			h.Set("RateLimit-Reset", strconv.Itoa(seconds(time.Until(d.ResetAt))))
+		}
+	}
+	if d.Policy != "" {
+		h.Set("RateLimit-Policy", d.Policy)
+	}
+	if !d.Allowed {
+		h.Set("Retry-After", strconv.Itoa(seconds(d.RetryAfter)))
+	}
+}
+
+// seconds rounds a duration up to whole seconds, so that clients never come
+// back too early.
+func seconds(d time.Duration) int {
+	return max(0, int((d+time.Second-1)/time.Second))
+}
+
+// statusCode works out the status code the client will receive for a request
+// that returned err. Errors are turned into responses further up the chain,
+// so the status has to be derived from the error itself.
+func statusCode(ctx context.Context, err error) int {
+	switch {
+	case err == nil:
+		return web.GetValues(ctx).StatusCode
+	case response.IsError(err):
+		return response.GetError(err).Status
+	case ratelimiter.IsRateLimitError(err):
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusInternalServerError
+	}
+}
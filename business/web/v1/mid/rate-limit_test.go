@@ -0,0 +1,279 @@
+package mid_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Zanda256/rate-limiter-go/business/data/cache"
+	"github.com/Zanda256/rate-limiter-go/business/web/v1/mid"
+	ratelimiter "github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter"
+	"github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter/penalty"
+	"github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter/priority"
+	"github.com/Zanda256/rate-limiter-go/foundation/logger"
+)
+
+func newLogger() *logger.Logger {
+	return logger.New(io.Discard, logger.LevelError, "TEST", func(context.Context) string { return "" })
+}
+
+// serve runs a request for user through the middleware and returns the
+// response headers along with the error it ended with.
+func serve(t *testing.T, cfg mid.RateLimitConfig, user string) (http.Header, error) {
+	t.Helper()
+
+	h := mid.RateLimit(cfg)(func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		return nil
+	})
+	r := httptest.NewRequest(http.MethodGet, "/v1/limited?user="+user, nil)
+	w := httptest.NewRecorder()
+	err := h(context.Background(), w, r)
+	return w.Header(), err
+}
+
+// brokenStore is a store that can't be reached.
+type brokenStore struct{}
+
+var errUnreachable = errors.New("dial tcp: connection refused")
+
+func (brokenStore) StoreValue(ctx context.Context, key string, value any, ttl int) (any, error) {
+	return nil, errUnreachable
+}
+
+func (brokenStore) RetrieveValue(ctx context.Context, key string) (any, error) {
+	return nil, errUnreachable
+}
+
+func (brokenStore) Increment(ctx context.Context, key string, n int64) (int64, error) {
+	return 0, errUnreachable
+}
+
+func (brokenStore) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	return errUnreachable
+}
+
+func (brokenStore) CompareAndSet(ctx context.Context, key string, old string, value any, ttl time.Duration) (bool, error) {
+	return false, errUnreachable
+}
+
+func (brokenStore) DeleteValues(ctx context.Context, keys ...string) error {
+	return errUnreachable
+}
+
+func TestRateLimitStoreFailure(t *testing.T) {
+	tests := []struct {
+		onFailure string
+		wantErr   bool
+		policy    string
+	}{
+		{onFailure: ratelimiter.FailClosed, wantErr: true},
+		{onFailure: ratelimiter.FailOpen, policy: "basic:fail-open"},
+		{onFailure: ratelimiter.FailLocal, policy: "basic:local"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.onFailure, func(t *testing.T) {
+			log := newLogger()
+			var store brokenStore
+
+			tiers, err := ratelimiter.NewTieredLimiter(ratelimiter.TieredLimiterConfig{
+				Tiers: map[string]ratelimiter.Tier{
+					ratelimiter.DefaultTier: {Algo: ratelimiter.FixedWindow, Period: 60, Capacity: 2, OnFailure: tt.onFailure},
+				},
+				KvStore: store,
+				Log:     log,
+			})
+			if err != nil {
+				t.Fatalf("constructing tiers: %s", err)
+			}
+			jail, err := penalty.NewJail(penalty.JailConfig{Store: store, Log: log})
+			if err != nil {
+				t.Fatalf("constructing jail: %s", err)
+			}
+
+			cfg := mid.RateLimitConfig{
+				Log:     log,
+				Limiter: tiers,
+				Jail:    jail,
+			}
+
+			h, err := serve(t, cfg, "alice")
+			if tt.wantErr {
+				if err == nil || ratelimiter.IsRateLimitError(err) {
+					t.Fatalf("got %v, want the store error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got %v, want the request admitted", err)
+			}
+			if got := h.Get("RateLimit-Policy"); got != tt.policy {
+				t.Errorf("got policy %q, want %q", got, tt.policy)
+			}
+
+			// Fail-open decisions have no limit to report, the local
+			// fallback enforces half of the tier's.
+			want := ""
+			if tt.onFailure == ratelimiter.FailLocal {
+				want = "1"
+			}
+			if got := h.Get("RateLimit-Limit"); got != want {
+				t.Errorf("got RateLimit-Limit %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestRateLimitRefundsOnGlobalDenial(t *testing.T) {
+	// Each tier has room for two requests, or one in flight. The global limit
+	// only lets the first request through, and the tier must get its units
+	// back from every other one, or it would deny the third request itself.
+	tests := []struct {
+		name string
+		tier ratelimiter.Tier
+	}{
+		{name: "fixed window", tier: ratelimiter.Tier{Algo: ratelimiter.FixedWindow, Period: 60, Capacity: 2}},
+		{name: "adaptive", tier: ratelimiter.Tier{Algo: ratelimiter.Adaptive, Capacity: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log := newLogger()
+			store := cache.NewMemoryCache(cache.MemoryConfig{})
+			defer store.Close()
+
+			tiers, err := ratelimiter.NewTieredLimiter(ratelimiter.TieredLimiterConfig{
+				Tiers:   map[string]ratelimiter.Tier{ratelimiter.DefaultTier: tt.tier},
+				KvStore: store,
+				Log:     log,
+			})
+			if err != nil {
+				t.Fatalf("constructing tiers: %s", err)
+			}
+			global, err := ratelimiter.NewGlobalLimit(ratelimiter.GlobalLimitConfig{
+				Global: ratelimiter.GlobalConfig{
+					Scope: "test",
+					Tier:  ratelimiter.Tier{Algo: ratelimiter.FixedWindow, Period: 60, Capacity: 1},
+				},
+				KvStore: store,
+				Log:     log,
+			})
+			if err != nil {
+				t.Fatalf("constructing global limit: %s", err)
+			}
+
+			cfg := mid.RateLimitConfig{
+				Log:     log,
+				Limiter: tiers,
+				Global:  global,
+			}
+
+			if _, err := serve(t, cfg, "alice"); err != nil {
+				t.Fatalf("first request: %s", err)
+			}
+			for i := 2; i <= 3; i++ {
+				_, err := serve(t, cfg, "alice")
+				if !ratelimiter.IsRateLimitError(err) {
+					t.Fatalf("request %d: got %v, want a rate limit error", i, err)
+				}
+				if want := "global limit exceeded"; err.Error() != want {
+					t.Fatalf("request %d: got %q, want %q", i, err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimitQueue(t *testing.T) {
+	// The bucket drains a unit every 30 seconds, so the second request in a
+	// row is queued behind the first.
+	tests := []struct {
+		name     string
+		maxDelay time.Duration
+		timeout  time.Duration
+		want     func(err error) bool
+	}{
+		{
+			name:    "cancelled",
+			timeout: 20 * time.Millisecond,
+			want:    func(err error) bool { return errors.Is(err, context.DeadlineExceeded) },
+		},
+		{
+			name:     "delay too long",
+			maxDelay: time.Second,
+			timeout:  time.Minute,
+			want: func(err error) bool {
+				return ratelimiter.IsRateLimitError(err) && strings.Contains(err.Error(), "queued")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log := newLogger()
+			store := cache.NewMemoryCache(cache.MemoryConfig{})
+			defer store.Close()
+
+			tiers, err := ratelimiter.NewTieredLimiter(ratelimiter.TieredLimiterConfig{
+				Tiers: map[string]ratelimiter.Tier{
+					ratelimiter.DefaultTier: {Algo: ratelimiter.LeakyBucket, Mode: "queue", Period: 60, Capacity: 2},
+				},
+				KvStore: store,
+				Log:     log,
+			})
+			if err != nil {
+				t.Fatalf("constructing tiers: %s", err)
+			}
+
+			shedder, err := priority.NewShedder(priority.ShedderConfig{
+				Log:   log,
+				Store: store,
+				Config: priority.Config{
+					Period:       60,
+					Budget:       2,
+					DefaultClass: "default",
+					Classes:      []priority.Class{{Name: "default"}},
+				},
+			})
+			if err != nil {
+				t.Fatalf("constructing shedder: %s", err)
+			}
+
+			var served int
+			h := mid.RateLimit(mid.RateLimitConfig{
+				Log:      log,
+				Limiter:  tiers,
+				Shedder:  shedder,
+				MaxDelay: tt.maxDelay,
+			})(func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+				served++
+				return nil
+			})
+			do := func() error {
+				ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+				defer cancel()
+				r := httptest.NewRequest(http.MethodGet, "/v1/limited?user=alice", nil).WithContext(ctx)
+				return h(ctx, httptest.NewRecorder(), r)
+			}
+
+			if err := do(); err != nil {
+				t.Fatalf("first request: %s", err)
+			}
+
+			// The queued request is turned away, and must give its place in
+			// the queue and its share of the load budget back: the bucket has
+			// room for a single queued request and the budget for two, so the
+			// next one would be denied or shed outright otherwise.
+			for i := 2; i <= 3; i++ {
+				if err := do(); !tt.want(err) {
+					t.Fatalf("request %d: got %v", i, err)
+				}
+			}
+			if served != 1 {
+				t.Errorf("got %d requests served, want 1", served)
+			}
+		})
+	}
+}
@@ -8,21 +8,46 @@ import (
 	"time"
 
 	"github.com/Zanda256/rate-limiter-go/business/data/cache"
+	"github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter/decision"
 	"github.com/Zanda256/rate-limiter-go/foundation/logger"
 )
 
 const RoundedToSeconds = "2006-01-02 15:04:05"
 
+const keyPrefix = "fixedwindow:"
+
+// windowScript counts requests against the counter of the current window,
+// which expires when the window ends.
+//
+//	KEYS[1] counter of the current window
+//	ARGV[1] cost of the request
+//	ARGV[2] requests allowed in a window
+//	ARGV[3] end of the window, unix time in milliseconds
+//
+// It returns {1, requests after the request} when the request fits, or
+// {0, current requests} when it doesn't.
+var windowScript = cache.NewScript(`
+local cost = tonumber(ARGV[1])
+local requests = tonumber(redis.call("GET", KEYS[1]) or "0")
+if requests + cost > tonumber(ARGV[2]) then
+	return {0, requests}
+end
+
+requests = redis.call("INCRBY", KEYS[1], cost)
+redis.call("PEXPIREAT", KEYS[1], ARGV[3])
+return {1, requests}
+`)
+
 type WindowController struct {
 	Log        *logger.Logger
-	Store      *cache.RedisCache
+	Store      cache.Store
 	WindowSize int64
 	MaxTokens  int
 }
 
 type WindowControllerConfig struct {
 	Log        *logger.Logger
-	Store      *cache.RedisCache
+	Store      cache.Store
 	WindowSize int64
 	MaxTokens  int
 }
@@ -74,94 +99,112 @@ func (wc *WindowController) NewWindow(cfg WindowConfig) Window {
 	}
 }
 
-func (wc *WindowController) Accept(userID string) bool {
-	v, err := wc.getWindow(userID)
+// Accept counts cost requests against the user's current window, reporting
+// whether they fit.
+func (wc *WindowController) Accept(userID string, cost int) decision.Decision {
+	if cost > wc.MaxTokens {
+		wc.Log.Info(context.Background(), "cost exceeds window capacity", "userID", userID, "cost", cost)
+		return decision.Decision{Limit: wc.MaxTokens}
+	}
+
+	allowed, wnd, err := wc.count(userID, cost)
 	if err != nil {
-		// If the key isn't present, create a new one
-		if errors.Is(err, cache.ErrKeyNotFound) { // move to string constatnt later
-			newWnd := wc.NewWindow(WindowConfig{
-				UserID:     userID,
-				WindowSize: wc.WindowSize,
-				MaxTokens:  wc.MaxTokens,
-			})
-			if _, err = wc.updateRequests(newWnd); err != nil {
-				wc.Log.Error(context.Background(), fmt.Sprintf("updateTokens: %s", err.Error()))
-				return false
-			}
-			wc.Log.Info(context.Background(), "successfully stored new value", newWnd)
-			//If no error accept the request
-			return true
-		}
-		// Other error type we log it and return false
-		wc.Log.Error(context.Background(), fmt.Sprintf("Store bucket value failed: %s", err.Error()))
-		return false
+		wc.Log.Error(context.Background(), fmt.Sprintf("fixed window: %s", err.Error()))
+		return decision.Error(err)
 	}
-	theWindow := Window{}
-	var (
-		windowInBytes string
-		ok            bool
-	)
-
-	if windowInBytes, ok = v.(string); !ok {
-		wc.Log.Info(context.Background(), "cannot marshal retrieved value into string")
-		return false
+	return wc.decide(wnd, allowed)
+}
+
+// count adds cost requests to the user's current window if they fit, and
+// returns the window as it was left, atomically (see cache.Update).
+func (wc *WindowController) count(userID string, cost int) (bool, Window, error) {
+	wnd := wc.NewWindow(WindowConfig{
+		UserID:     userID,
+		WindowSize: wc.WindowSize,
+		MaxTokens:  wc.MaxTokens,
+	})
+	end := time.Unix((wnd.CreatedAt+1)*wc.WindowSize, 0)
+
+	sr, ok := wc.Store.(cache.ScriptRunner)
+	if !ok {
+		return wc.countCAS(wnd, cost, end)
 	}
 
-	if err = UnmarshalBinarytoWindow([]byte(windowInBytes), &theWindow); err != nil {
-		wc.Log.Info(context.Background(), "cannot marshal retrieved value into Window")
-		return false
+	key := windowKey(userID, wnd.CreatedAt)
+	res, err := sr.RunScript(context.Background(), windowScript, []string{key}, cost, wc.MaxTokens, end.UnixMilli())
+	if err != nil {
+		return false, Window{}, err
 	}
 
-	nowUnix := time.Now().Unix()
-	currentWindow := nowUnix / wc.WindowSize
+	vals, ok := res.([]any)
+	if !ok || len(vals) != 2 {
+		return false, Window{}, errors.New("unexpected script result")
+	}
+	allowed, ok1 := vals[0].(int64)
+	requests, ok2 := vals[1].(int64)
+	if !ok1 || !ok2 {
+		return false, Window{}, errors.New("unexpected script result")
+	}
+	wnd.Requests = int(requests)
+	return allowed == 1, wnd, nil
+}
 
-	if currentWindow == theWindow.CreatedAt {
-		// still in current time window, check availability of requests
-		if theWindow.Requests >= theWindow.MaxRequests {
-			return false
+func (wc *WindowController) countCAS(current Window, cost int, end time.Time) (bool, Window, error) {
+	var allowed bool
+	var wnd Window
+	err := cache.UpdateJSON(context.Background(), wc.Store, keyPrefix+current.UserID, time.Until(end), &wnd, func(w *Window) (bool, error) {
+		// Start over once the stored window has ended.
+		if w.CreatedAt != current.CreatedAt {
+			*w = current
 		}
-		// valid request, update window object
-		if _, err = wc.updateRequests(theWindow); err != nil {
-			wc.Log.Error(context.Background(), fmt.Sprintf("updateTokens: %s", err.Error()))
-			return false
+		w.MaxRequests = current.MaxRequests
+		if allowed = w.Requests+cost <= w.MaxRequests; !allowed {
+			return false, nil
 		}
-		return true
-	}
-	// create new window object
-	newWnd := wc.NewWindow(WindowConfig{
+		w.Requests += cost
+		return true, nil
+	})
+	return allowed, wnd, err
+}
+
+// Refund takes cost requests off the user's current window.
+func (wc *WindowController) Refund(userID string, cost int) error {
+	current := wc.NewWindow(WindowConfig{
 		UserID:     userID,
 		WindowSize: wc.WindowSize,
 		MaxTokens:  wc.MaxTokens,
 	})
-	if _, err = wc.updateRequests(newWnd); err != nil {
-		wc.Log.Error(context.Background(), fmt.Sprintf("updateTokens: %s", err.Error()))
-		return false
+
+	if _, ok := wc.Store.(cache.ScriptRunner); ok {
+		return cache.Decrement(context.Background(), wc.Store, int64(cost), windowKey(userID, current.CreatedAt))
 	}
-	return true
+
+	var wnd Window
+	return cache.UpdateJSON(context.Background(), wc.Store, keyPrefix+userID, 0, &wnd, func(w *Window) (bool, error) {
+		if w.CreatedAt != current.CreatedAt || w.Requests == 0 {
+			return false, nil
+		}
+		w.Requests = max(0, w.Requests-cost)
+		return true, nil
+	})
 }
 
-func (bc *WindowController) getWindow(UserID string) (any, error) {
-	v, err := bc.Store.RetrieveValue(context.Background(), UserID)
-	if err != nil {
-		bc.Log.Error(context.Background(), "checkbucket: %s", err.Error())
-		return nil, err
-	}
-	if v == nil {
-		bc.Log.Warn(context.Background(), "key not found")
-		return nil, cache.ErrKeyNotFound
-	}
-	bc.Log.Info(context.Background(), "bucket in check bucket: %+v", v)
-	return v, nil
+// windowKey returns the key of the counter of one of the user's windows.
+func windowKey(userID string, windowID int64) string {
+	return fmt.Sprintf("%s{%s}:%d", keyPrefix, userID, windowID)
 }
 
-func (bc *WindowController) updateRequests(w Window) (Window, error) {
-	// increment requests by 1 and persist the result. If successful,accept and process the request.
-	w.Requests += 1
-	res, err := bc.Store.StoreValue(context.Background(), w.UserID, w, 30)
-	if err != nil {
-		bc.Log.Error(context.Background(), fmt.Sprintf("Store window value failed: %s", err.Error()))
-		return Window{}, err
+// decide builds the decision for the window as it was left by the request.
+func (wc *WindowController) decide(w Window, allowed bool) decision.Decision {
+	resetAt := time.Unix((w.CreatedAt+1)*wc.WindowSize, 0)
+	d := decision.Decision{
+		Allowed:   allowed,
+		Limit:     w.MaxRequests,
+		Remaining: w.MaxRequests - w.Requests,
+		ResetAt:   resetAt,
+	}
+	if !allowed {
+		d.RetryAfter = time.Until(resetAt)
 	}
-	w = res.(Window)
-	return w, nil
+	return d
 }
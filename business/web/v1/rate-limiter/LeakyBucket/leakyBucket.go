@@ -1 +1,246 @@
 package leakybucket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/Zanda256/rate-limiter-go/business/data/cache"
+	"github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter/decision"
+	"github.com/Zanda256/rate-limiter-go/foundation/logger"
+)
+
+// Supported modes of operation for the leaky bucket.
+const (
+	// ModeMeter rejects a request when adding it would overflow the bucket.
+	ModeMeter = "meter"
+	// ModeQueue holds a request until everything ahead of it has leaked out,
+	// rejecting it only when the queue is full.
+	ModeQueue = "queue"
+)
+
+const keyPrefix = "leakybucket:"
+
+// leakScript drains a leaky bucket and pours a request into it. The bucket is
+// kept in a hash holding its level and the time it was last drained at.
+//
+//	KEYS[1] bucket
+//	ARGV[1] now, unix time in microseconds
+//	ARGV[2] capacity
+//	ARGV[3] time it takes for one unit to leak out, in microseconds
+//	ARGV[4] cost of the request, negative to take water out
+//
+// It returns {1, level after the request} when the request fits, or
+// {0, current level} when it would overflow the bucket. Levels are returned
+// as strings because they are fractional.
+var leakScript = cache.NewScript(`
+local now = tonumber(ARGV[1])
+local interval = tonumber(ARGV[3])
+local cost = tonumber(ARGV[4])
+
+local state = redis.call("HMGET", KEYS[1], "level", "ts")
+local level = tonumber(state[1]) or 0
+local ts = tonumber(state[2]) or now
+if now > ts then
+	level = math.max(0, level - (now - ts) / interval)
+	ts = now
+end
+
+if level + cost > tonumber(ARGV[2]) then
+	return {0, tostring(level)}
+end
+
+level = math.max(0, level + cost)
+redis.call("HSET", KEYS[1], "level", tostring(level), "ts", string.format("%.0f", ts))
+redis.call("PEXPIRE", KEYS[1], math.max(1, math.ceil(level * interval / 1000)))
+return {1, tostring(level)}
+`)
+
+// LeakyBucket is the data representation of a bucket. Level is the amount of
+// water (requests) currently in the bucket and LastLeak is the unix time in
+// nanoseconds at which Level was last drained.
+type LeakyBucket struct {
+	UserID   string  `json:"userID"`
+	Level    float64 `json:"level"`
+	LastLeak int64   `json:"lastLeak"`
+}
+
+// To be stored in redis, we need to implement this interface.
+func (b LeakyBucket) MarshalBinary() (data []byte, err error) {
+	data, err = json.Marshal(b)
+	return
+}
+
+func UnmarshalBinarytoLB(data []byte, b *LeakyBucket) error {
+	err := json.Unmarshal(data, b)
+	if err != nil {
+		return fmt.Errorf("unmarshal to LeakyBucket{} failed %+v", err.Error())
+	}
+	return nil
+}
+
+// BucketController manages bucket creation, and state of individual buckets.
+// Buckets hold at most Cap requests, the largest burst allowed, and drain at
+// the fixed rate of Rate requests every Period seconds.
+type BucketController struct {
+	Period, Cap int
+	Rate        int
+	Mode        string
+	Store       cache.Store
+	Log         *logger.Logger
+}
+
+// BucketControllerConfig configures a BucketController. Capacity is the
+// size of the bucket; Rate defaults to it.
+type BucketControllerConfig struct {
+	Store    cache.Store
+	Log      *logger.Logger
+	Period   int
+	Capacity int
+	Rate     int
+	Mode     string
+}
+
+func NewBucketController(cfg BucketControllerConfig) *BucketController {
+	mode := cfg.Mode
+	if mode == "" {
+		mode = ModeMeter
+	}
+	rate := cfg.Rate
+	if rate < 1 {
+		rate = cfg.Capacity
+	}
+	return &BucketController{
+		Period: cfg.Period,
+		Cap:    cfg.Capacity,
+		Rate:   rate,
+		Mode:   mode,
+		Store:  cfg.Store,
+		Log:    cfg.Log,
+	}
+}
+
+// leakInterval is the time it takes for one request to leak out of the bucket.
+func (bc *BucketController) leakInterval() time.Duration {
+	return time.Duration(bc.Period) * time.Second / time.Duration(bc.Rate)
+}
+
+// Accept pours cost units of water into the user's bucket. In queue mode the
+// decision of an admitted request is delayed until the water ahead of it has
+// leaked out of the bucket, which smooths bursts into a constant output rate.
+func (bc *BucketController) Accept(userID string, cost int) decision.Decision {
+	now := time.Now()
+
+	allowed, buckt, err := bc.pour(userID, cost, now)
+	if err != nil {
+		bc.Log.Error(context.Background(), fmt.Sprintf("leaky bucket: %s", err.Error()))
+		return decision.Error(err)
+	}
+
+	if !allowed {
+		bc.Log.Info(context.Background(), "leaky bucket overflow", "userID", userID, "mode", bc.Mode)
+		d := bc.decide(buckt, now, false)
+		d.RetryAfter = time.Duration((buckt.Level + float64(cost) - float64(bc.Cap)) * float64(bc.leakInterval()))
+		return d
+	}
+
+	d := bc.decide(buckt, now, true)
+	if bc.Mode == ModeQueue {
+		// Everything already in the bucket has to drain before this request
+		// can.
+		d.Delay = max(0, time.Duration((buckt.Level-float64(cost))*float64(bc.leakInterval())))
+	}
+	return d
+}
+
+// Refund takes cost units of water back out of the user's bucket.
+func (bc *BucketController) Refund(userID string, cost int) error {
+	_, _, err := bc.pour(userID, -cost, time.Now())
+	return err
+}
+
+// pour drains the user's bucket up to now and adds cost units of water to it
+// if they fit, returning the bucket as it was left. A negative cost takes
+// water out, never leaving less than none.
+func (bc *BucketController) pour(userID string, cost int, now time.Time) (bool, LeakyBucket, error) {
+	sr, ok := bc.Store.(cache.ScriptRunner)
+	if !ok {
+		return bc.pourCAS(userID, cost, now)
+	}
+
+	res, err := sr.RunScript(context.Background(), leakScript, []string{keyPrefix + userID},
+		now.UnixMicro(), bc.Cap, bc.leakInterval().Microseconds(), cost)
+	if err != nil {
+		return false, LeakyBucket{}, err
+	}
+
+	vals, ok := res.([]any)
+	if !ok || len(vals) != 2 {
+		return false, LeakyBucket{}, errors.New("unexpected script result")
+	}
+	allowed, ok1 := vals[0].(int64)
+	lvl, ok2 := vals[1].(string)
+	if !ok1 || !ok2 {
+		return false, LeakyBucket{}, errors.New("unexpected script result")
+	}
+	level, err := strconv.ParseFloat(lvl, 64)
+	if err != nil {
+		return false, LeakyBucket{}, fmt.Errorf("parsing level: %w", err)
+	}
+
+	return allowed == 1, LeakyBucket{UserID: userID, Level: level, LastLeak: now.UnixNano()}, nil
+}
+
+func (bc *BucketController) pourCAS(userID string, cost int, now time.Time) (bool, LeakyBucket, error) {
+	// A full bucket drains completely within Cap leak intervals, so the value
+	// does not need to outlive them.
+	ttl := time.Duration(bc.Cap) * bc.leakInterval()
+
+	var allowed bool
+	var buckt LeakyBucket
+	err := cache.UpdateJSON(context.Background(), bc.Store, keyPrefix+userID, ttl, &buckt, func(b *LeakyBucket) (bool, error) {
+		if b.UserID == "" {
+			*b = LeakyBucket{
+				UserID:   userID,
+				LastLeak: now.UnixNano(),
+			}
+		}
+		bc.leak(b, now)
+
+		if allowed = b.Level+float64(cost) <= float64(bc.Cap); !allowed {
+			return false, nil
+		}
+		b.Level = math.Max(0, b.Level+float64(cost))
+		return true, nil
+	})
+	return allowed, buckt, err
+}
+
+// decide builds the decision for the bucket as it was left by the request.
+// The bucket resets once all of its water has leaked out.
+func (bc *BucketController) decide(b LeakyBucket, now time.Time, allowed bool) decision.Decision {
+	return decision.Decision{
+		Allowed:   allowed,
+		Limit:     bc.Cap,
+		Remaining: int(math.Floor(float64(bc.Cap) - b.Level)),
+		ResetAt:   now.Add(time.Duration(b.Level * float64(bc.leakInterval()))),
+	}
+}
+
+// leak drains the water that has leaked out of the bucket since it was last
+// drained.
+func (bc *BucketController) leak(b *LeakyBucket, now time.Time) {
+	elapsed := now.Sub(time.Unix(0, b.LastLeak))
+	if elapsed <= 0 {
+		return
+	}
+	b.Level -= float64(elapsed) / float64(bc.leakInterval())
+	if b.Level < 0 {
+		b.Level = 0
+	}
+	b.LastLeak = now.UnixNano()
+}
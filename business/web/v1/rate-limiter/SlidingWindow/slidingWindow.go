@@ -1 +1,245 @@
 package slidingwindow
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/Zanda256/rate-limiter-go/business/data/cache"
+	"github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter/decision"
+	"github.com/Zanda256/rate-limiter-go/foundation/logger"
+)
+
+const keyPrefix = "slidingwindow:"
+
+// windowScript counts a request against the current window if the estimated
+// count of the sliding window leaves room for it.
+//
+//	KEYS[1] counter of the current window
+//	KEYS[2] counter of the previous window
+//	ARGV[1] cost of the request
+//	ARGV[2] requests allowed in a window
+//	ARGV[3] fraction of the current window that has elapsed
+//	ARGV[4] ttl of the counters, in milliseconds
+//
+// It returns {allowed, current count, previous count}, with the counts taken
+// before the request.
+var windowScript = cache.NewScript(`
+local cost = tonumber(ARGV[1])
+local current = tonumber(redis.call("GET", KEYS[1]) or "0")
+local previous = tonumber(redis.call("GET", KEYS[2]) or "0")
+if previous * (1 - tonumber(ARGV[3])) + current + cost > tonumber(ARGV[2]) then
+	return {0, current, previous}
+end
+
+redis.call("INCRBY", KEYS[1], cost)
+redis.call("PEXPIRE", KEYS[1], ARGV[4])
+return {1, current, previous}
+`)
+
+// WindowController approximates a sliding window by weighting the count of the
+// previous fixed window by how much of it still overlaps the sliding window.
+// This removes the double bursts a fixed window allows at window boundaries.
+type WindowController struct {
+	Log        *logger.Logger
+	Store      cache.Store
+	WindowSize int64
+	MaxTokens  int
+}
+
+type WindowControllerConfig struct {
+	Log        *logger.Logger
+	Store      cache.Store
+	WindowSize int64
+	MaxTokens  int
+}
+
+func NewWindowController(cfg WindowControllerConfig) *WindowController {
+	return &WindowController{
+		Log:        cfg.Log,
+		Store:      cfg.Store,
+		WindowSize: cfg.WindowSize,
+		MaxTokens:  cfg.MaxTokens,
+	}
+}
+
+// Window holds the request counts of the current fixed window and the one
+// before it. WindowID is the index of the current window, unixTime / WindowSize.
+type Window struct {
+	UserID   string `json:"userId"`
+	WindowID int64  `json:"windowId"`
+	Current  int    `json:"current"`
+	Previous int    `json:"previous"`
+}
+
+func (w Window) MarshalBinary() (data []byte, err error) {
+	data, err = json.Marshal(w)
+	return
+}
+
+func UnmarshalBinarytoWindow(data []byte, w *Window) error {
+	err := json.Unmarshal(data, w)
+	if err != nil {
+		return fmt.Errorf("unmarshal to Window{} failed %+v", err.Error())
+	}
+	return nil
+}
+
+// slide moves the window forward so that WindowID is the window containing
+// now. Counts of windows that are no longer adjacent are dropped.
+func (w *Window) slide(currentID int64) {
+	switch currentID - w.WindowID {
+	case 0:
+		return
+	case 1:
+		w.Previous = w.Current
+	default:
+		w.Previous = 0
+	}
+	w.Current = 0
+	w.WindowID = currentID
+}
+
+// Accept reports whether the user may make a request costing cost units. The
+// estimated count is previous * (1 - elapsed fraction of current window) +
+// current.
+func (wc *WindowController) Accept(userID string, cost int) decision.Decision {
+	now := time.Now()
+	size := time.Duration(wc.WindowSize) * time.Second
+	currentID := now.UnixNano() / int64(size)
+	resetAt := time.Unix(0, (currentID+1)*int64(size))
+	elapsed := float64(now.UnixNano()%int64(size)) / float64(size)
+
+	allowed, wnd, err := wc.count(userID, cost, currentID, elapsed)
+	if err != nil {
+		wc.Log.Error(context.Background(), fmt.Sprintf("sliding window: %s", err.Error()))
+		return decision.Error(err)
+	}
+
+	estimate := float64(wnd.Previous)*(1-elapsed) + float64(wnd.Current)
+
+	d := decision.Decision{
+		Limit:   wc.MaxTokens,
+		ResetAt: resetAt,
+	}
+
+	if !allowed {
+		wc.Log.Info(context.Background(), "sliding window limit reached", "userID", userID, "estimate", estimate)
+		d.Remaining = int(math.Max(0, math.Floor(float64(wc.MaxTokens)-estimate)))
+		d.RetryAfter = wc.retryAfter(wnd, elapsed, cost)
+		return d
+	}
+
+	d.Allowed = true
+	d.Remaining = int(math.Floor(float64(wc.MaxTokens) - estimate - float64(cost)))
+	return d
+}
+
+// count adds cost to the user's current window if the estimated count leaves
+// room for it, and returns the window as it was before the request.
+func (wc *WindowController) count(userID string, cost int, currentID int64, elapsed float64) (bool, Window, error) {
+	// The previous window stops mattering two windows after it started.
+	ttl := 2 * time.Duration(wc.WindowSize) * time.Second
+
+	sr, ok := wc.Store.(cache.ScriptRunner)
+	if !ok {
+		return wc.countCAS(userID, cost, currentID, elapsed, ttl)
+	}
+
+	keys := []string{
+		windowKey(userID, currentID),
+		windowKey(userID, currentID-1),
+	}
+	res, err := sr.RunScript(context.Background(), windowScript, keys,
+		cost, wc.MaxTokens, strconv.FormatFloat(elapsed, 'f', -1, 64), ttl.Milliseconds())
+	if err != nil {
+		return false, Window{}, err
+	}
+
+	vals, ok := res.([]any)
+	if !ok || len(vals) != 3 {
+		return false, Window{}, errors.New("unexpected script result")
+	}
+	allowed, ok1 := vals[0].(int64)
+	current, ok2 := vals[1].(int64)
+	previous, ok3 := vals[2].(int64)
+	if !ok1 || !ok2 || !ok3 {
+		return false, Window{}, errors.New("unexpected script result")
+	}
+
+	return allowed == 1, Window{
+		UserID:   userID,
+		WindowID: currentID,
+		Current:  int(current),
+		Previous: int(previous),
+	}, nil
+}
+
+func (wc *WindowController) countCAS(userID string, cost int, currentID int64, elapsed float64, ttl time.Duration) (bool, Window, error) {
+	var allowed bool
+	var before Window
+	var wnd Window
+	err := cache.UpdateJSON(context.Background(), wc.Store, keyPrefix+userID, ttl, &wnd, func(w *Window) (bool, error) {
+		if w.UserID == "" {
+			*w = Window{
+				UserID:   userID,
+				WindowID: currentID,
+			}
+		}
+		w.slide(currentID)
+		before = *w
+
+		estimate := float64(w.Previous)*(1-elapsed) + float64(w.Current)
+		if allowed = estimate+float64(cost) <= float64(wc.MaxTokens); !allowed {
+			return false, nil
+		}
+		w.Current += cost
+		return true, nil
+	})
+	return allowed, before, err
+}
+
+// Refund takes cost requests off the count of the user's current window. The
+// previous window is left alone.
+func (wc *WindowController) Refund(userID string, cost int) error {
+	size := time.Duration(wc.WindowSize) * time.Second
+	currentID := time.Now().UnixNano() / int64(size)
+
+	if _, ok := wc.Store.(cache.ScriptRunner); ok {
+		return cache.Decrement(context.Background(), wc.Store, int64(cost), windowKey(userID, currentID))
+	}
+
+	var wnd Window
+	return cache.UpdateJSON(context.Background(), wc.Store, keyPrefix+userID, 0, &wnd, func(w *Window) (bool, error) {
+		if w.WindowID != currentID || w.Current == 0 {
+			return false, nil
+		}
+		w.Current = max(0, w.Current-cost)
+		return true, nil
+	})
+}
+
+// windowKey returns the key of the counter of one of the user's windows.
+func windowKey(userID string, windowID int64) string {
+	return fmt.Sprintf("%s{%s}:%d", keyPrefix, userID, windowID)
+}
+
+// retryAfter estimates how long it takes for the weight of the previous
+// window to decay enough for the request to fit. If the current window alone
+// is too full, the request has to wait for the next window at least.
+func (wc *WindowController) retryAfter(w Window, elapsed float64, cost int) time.Duration {
+	size := time.Duration(wc.WindowSize) * time.Second
+
+	room := float64(wc.MaxTokens - w.Current - cost)
+	if room < 0 || w.Previous == 0 {
+		return time.Duration((1 - elapsed) * float64(size))
+	}
+
+	// previous * (1 - fraction) + current + cost <= max
+	fraction := 1 - room/float64(w.Previous)
+	return time.Duration((fraction - elapsed) * float64(size))
+}
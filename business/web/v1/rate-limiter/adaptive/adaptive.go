@@ -0,0 +1,195 @@
+package adaptive
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter/decision"
+	"github.com/Zanda256/rate-limiter-go/foundation/logger"
+)
+
+// Defaults used for the settings that aren't configured.
+const (
+	DefaultLatencyTarget = 250 * time.Millisecond
+	DefaultMaxErrorRate  = 0.05
+	DefaultIncrease      = 1
+	DefaultBackoff       = 0.5
+	DefaultInterval      = time.Second
+)
+
+// Settings tune how the limit reacts to the health of the backend. They are
+// read from the "adaptive" object of a tier.
+type Settings struct {
+	MinCapacity     int     `json:"minCapacity,omitempty"`
+	LatencyTargetMs int     `json:"latencyTargetMs,omitempty"`
+	MaxErrorRate    float64 `json:"maxErrorRate,omitempty"`
+	Increase        float64 `json:"increase,omitempty"`
+	Backoff         float64 `json:"backoff,omitempty"`
+	IntervalMs      int     `json:"intervalMs,omitempty"`
+}
+
+// Limiter caps the number of requests this instance has in flight. The cap is
+// adjusted with additive increase, multiplicative decrease (AIMD): every
+// interval it grows by Increase while latency and the 5xx rate stay within
+// their targets, and it is multiplied by Backoff when either is exceeded. It
+// never leaves [MinLimit, MaxLimit]. The cap protects the backend rather than
+// any one user, so userID is ignored: a single cap is shared by every user of
+// the tier, and it isn't kept in a store, so each instance adapts its own.
+type Limiter struct {
+	Log           *logger.Logger
+	MinLimit      float64
+	MaxLimit      float64
+	LatencyTarget time.Duration
+	MaxErrorRate  float64
+	Increase      float64
+	Backoff       float64
+	Interval      time.Duration
+
+	mu           sync.Mutex
+	limit        float64
+	inFlight     int
+	samples      int
+	failures     int
+	totalLatency time.Duration
+	windowStart  time.Time
+}
+
+type LimiterConfig struct {
+	Log         *logger.Logger
+	MaxCapacity int
+	Settings    Settings
+}
+
+func NewLimiter(cfg LimiterConfig) *Limiter {
+	s := cfg.Settings
+
+	l := Limiter{
+		Log:           cfg.Log,
+		MinLimit:      float64(s.MinCapacity),
+		MaxLimit:      float64(cfg.MaxCapacity),
+		LatencyTarget: time.Duration(s.LatencyTargetMs) * time.Millisecond,
+		MaxErrorRate:  s.MaxErrorRate,
+		Increase:      s.Increase,
+		Backoff:       s.Backoff,
+		Interval:      time.Duration(s.IntervalMs) * time.Millisecond,
+		windowStart:   time.Now(),
+	}
+	if l.MinLimit < 1 {
+		l.MinLimit = 1
+	}
+	if l.MaxLimit < l.MinLimit {
+		l.MaxLimit = l.MinLimit
+	}
+	if l.LatencyTarget <= 0 {
+		l.LatencyTarget = DefaultLatencyTarget
+	}
+	if l.MaxErrorRate <= 0 {
+		l.MaxErrorRate = DefaultMaxErrorRate
+	}
+	if l.Increase <= 0 {
+		l.Increase = DefaultIncrease
+	}
+	if l.Backoff <= 0 || l.Backoff >= 1 {
+		l.Backoff = DefaultBackoff
+	}
+	if l.Interval <= 0 {
+		l.Interval = DefaultInterval
+	}
+
+	// Start wide open and let the backend tell us otherwise.
+	l.limit = l.MaxLimit
+
+	return &l
+}
+
+// Accept admits the request if fewer than the current limit are in flight.
+// Every admitted request must be reported back through Observe, or through
+// Refund when it never reached the handler. A request occupies a single slot
+// whatever its cost.
+func (l *Limiter) Accept(userID string, cost int) decision.Decision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limit := int(l.limit)
+	if l.inFlight >= limit {
+		return decision.Decision{
+			Limit: limit,
+		}
+	}
+	l.inFlight++
+
+	return decision.Decision{
+		Allowed:   true,
+		Limit:     limit,
+		Remaining: limit - l.inFlight,
+	}
+}
+
+// Observe records how an admitted request fared and adjusts the limit once
+// the current interval is over.
+func (l *Limiter) Observe(userID string, latency time.Duration, statusCode int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inFlight--
+	l.samples++
+	l.totalLatency += latency
+	if statusCode >= http.StatusInternalServerError {
+		l.failures++
+	}
+
+	if time.Since(l.windowStart) < l.Interval {
+		return
+	}
+	l.adjust()
+}
+
+// Refund frees the slot of an admitted request that was turned away before it
+// reached the handler. The request says nothing about the health of the
+// backend, so it isn't recorded.
+func (l *Limiter) Refund(userID string, cost int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inFlight--
+	return nil
+}
+
+// adjust applies AIMD to the limit based on the samples of the interval that
+// just ended. It must be called with the mutex held.
+func (l *Limiter) adjust() {
+	avgLatency := l.totalLatency / time.Duration(l.samples)
+	errorRate := float64(l.failures) / float64(l.samples)
+
+	prev := l.limit
+	switch {
+	case avgLatency > l.LatencyTarget || errorRate > l.MaxErrorRate:
+		l.limit *= l.Backoff
+		if l.limit < l.MinLimit {
+			l.limit = l.MinLimit
+		}
+		l.Log.Warn(context.Background(), "adaptive limit decreased", "from", prev, "to", l.limit,
+			"avgLatency", avgLatency.String(), "errorRate", errorRate)
+
+	default:
+		l.limit += l.Increase
+		if l.limit > l.MaxLimit {
+			l.limit = l.MaxLimit
+		}
+	}
+
+	l.samples = 0
+	l.failures = 0
+	l.totalLatency = 0
+	l.windowStart = time.Now()
+}
+
+// Limit returns the current limit.
+func (l *Limiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return int(l.limit)
+}
@@ -0,0 +1,119 @@
+package concurrency
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/Zanda256/rate-limiter-go/business/data/cache"
+	"github.com/Zanda256/rate-limiter-go/foundation/logger"
+)
+
+const keyPrefix = "inflight:"
+
+// DefaultLeaseTTL is how long a slot is held without being renewed.
+const DefaultLeaseTTL = 30 * time.Second
+
+// Limiter caps the number of requests a user can have in flight at once. Every
+// admitted request holds a lease on a slot in a per user sorted set, scored by
+// the time the lease expires. Leases are renewed while the request runs, so a
+// slot is only reclaimed by expiry when the instance holding it has died.
+type Limiter struct {
+	Log         *logger.Logger
+	Store       cache.Store
+	MaxInFlight int
+	LeaseTTL    time.Duration
+}
+
+type LimiterConfig struct {
+	Log         *logger.Logger
+	Store       cache.Store
+	MaxInFlight int
+	LeaseTTL    time.Duration
+}
+
+func NewLimiter(cfg LimiterConfig) *Limiter {
+	ttl := cfg.LeaseTTL
+	if ttl <= 0 {
+		ttl = DefaultLeaseTTL
+	}
+	return &Limiter{
+		Log:         cfg.Log,
+		Store:       cfg.Store,
+		MaxInFlight: cfg.MaxInFlight,
+		LeaseTTL:    ttl,
+	}
+}
+
+// Acquire takes a slot for the user, reporting whether one was free. When it
+// succeeds the returned release function must be called once the request is
+// done; it is safe to call it more than once. It fails when the slots can't
+// be counted.
+func (l *Limiter) Acquire(userID string) (release func(), ok bool, err error) {
+	key := keyPrefix + userID
+	lease := fmt.Sprintf("%d-%d", time.Now().UnixNano(), rand.Int63())
+
+	count, err := l.renew(key, lease)
+	if err != nil {
+		return nil, false, fmt.Errorf("acquiring slot: %w", err)
+	}
+
+	if count > int64(l.MaxInFlight) {
+		l.remove(key, lease)
+		l.Log.Info(context.Background(), "concurrency limit reached", "userID", userID, "inFlight", count-1)
+		return nil, false, nil
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go l.keepAlive(key, lease, done, stopped)
+
+	// The renewer is stopped before the lease is removed, so that a renewal
+	// in progress can't add the lease back.
+	var once sync.Once
+	release = func() {
+		once.Do(func() {
+			close(done)
+			<-stopped
+			l.remove(key, lease)
+		})
+	}
+	return release, true, nil
+}
+
+// keepAlive renews the lease until done is closed, and closes stopped once it
+// has returned.
+func (l *Limiter) keepAlive(key string, lease string, done <-chan struct{}, stopped chan<- struct{}) {
+	defer close(stopped)
+
+	ticker := time.NewTicker(l.LeaseTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if _, err := l.renew(key, lease); err != nil {
+				l.Log.Error(context.Background(), fmt.Sprintf("renew lease: %s", err.Error()))
+			}
+		}
+	}
+}
+
+// renew extends the lease, dropping every lease that has expired, and returns
+// the number of leases held.
+func (l *Limiter) renew(key string, lease string) (int64, error) {
+	now := time.Now()
+	count, _, err := cache.AppendToLog(context.Background(), l.Store, key,
+		now.Add(l.LeaseTTL).UnixMicro(), now.UnixMicro(), l.LeaseTTL, lease)
+	return count, err
+}
+
+func (l *Limiter) remove(key string, lease string) {
+	if err := cache.RemoveFromLog(context.Background(), l.Store, key, lease); err != nil {
+		l.Log.Error(context.Background(), fmt.Sprintf("release slot: %s", err.Error()))
+	}
+}
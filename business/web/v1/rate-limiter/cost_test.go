@@ -0,0 +1,44 @@
+package ratelimiter_test
+
+import (
+	"testing"
+
+	ratelimiter "github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter"
+)
+
+func TestWeightedCost(t *testing.T) {
+	// Adaptive limiters count requests in flight whatever they cost.
+	algos := []string{
+		ratelimiter.TokenBucket, ratelimiter.FixedWindow, ratelimiter.LeakyBucket,
+		ratelimiter.SlidingWindow, ratelimiter.SlidingLog, ratelimiter.GCRA,
+		ratelimiter.MultiWindow, ratelimiter.Quota,
+	}
+	for _, algo := range algos {
+		t.Run(algo, func(t *testing.T) {
+			rl, err := ratelimiter.NewRateLimiter(ratelimiter.RateLimiterConfig{
+				Tier:    ratelimiter.Tier{Algo: algo, Period: 60, Capacity: 10, Quota: "day"},
+				KvStore: newRedis(t),
+				Log:     newLogger(),
+			})
+			if err != nil {
+				t.Fatalf("constructing limiter: %s", err)
+			}
+
+			steps := []struct {
+				cost int
+				want bool
+			}{
+				{cost: 4, want: true},
+				{cost: 4, want: true},
+				{cost: 4, want: false},
+				{cost: 2, want: true},
+				{cost: 1, want: false},
+			}
+			for i, s := range steps {
+				if got := rl.CheckUserLimit("alice", s.cost).Allowed; got != s.want {
+					t.Fatalf("request %d costing %d: got %t, want %t", i+1, s.cost, got, s.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+// Package decision provides the result every rate limiting algorithm returns.
+package decision
+
+import (
+	"time"
+)
+
+// Decision is the outcome of checking a request against a limit.
+//
+// Err is set when the limit couldn't be checked, for example because the store
+// is unreachable. Allowed is false in that case, but the request wasn't denied
+// by the limit; callers decide how to treat it.
+//
+// Delay is set by limiters that queue requests. An admitted request must wait
+// that long before it proceeds; the caller does the waiting, so that it can
+// give up when the request is cancelled.
+type Decision struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	ResetAt    time.Time
+	RetryAfter time.Duration
+	Delay      time.Duration
+	Policy     string
+	Err        error
+}
+
+// Error returns the decision for a limit that couldn't be checked.
+func Error(err error) Decision {
+	return Decision{
+		Err: err,
+	}
+}
+
+// Denied reports whether the limit itself rejected the request.
+func (d Decision) Denied() bool {
+	return !d.Allowed && d.Err == nil
+}
@@ -0,0 +1,54 @@
+package ratelimiter_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	ratelimiter "github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter"
+)
+
+func TestDecision(t *testing.T) {
+	algos := []string{
+		ratelimiter.TokenBucket, ratelimiter.FixedWindow, ratelimiter.LeakyBucket,
+		ratelimiter.SlidingWindow, ratelimiter.SlidingLog, ratelimiter.GCRA,
+		ratelimiter.MultiWindow, ratelimiter.Quota,
+	}
+	for _, algo := range algos {
+		t.Run(algo, func(t *testing.T) {
+			rl, err := ratelimiter.NewRateLimiter(ratelimiter.RateLimiterConfig{
+				Name:    "basic",
+				Tier:    ratelimiter.Tier{Algo: algo, Period: 60, Capacity: 3, Quota: "day"},
+				KvStore: newRedis(t),
+				Log:     newLogger(),
+			})
+			if err != nil {
+				t.Fatalf("constructing limiter: %s", err)
+			}
+
+			for i := 1; i <= 3; i++ {
+				d := rl.CheckUserLimit("alice", 1)
+				if !d.Allowed || d.Err != nil {
+					t.Fatalf("request %d: got %+v, want it allowed", i, d)
+				}
+				if d.Limit != 3 || d.Remaining != 3-i {
+					t.Errorf("request %d: got %d of %d remaining, want %d of 3", i, d.Remaining, d.Limit, 3-i)
+				}
+				if !strings.HasPrefix(d.Policy, "basic") {
+					t.Errorf("request %d: got policy %q, want it named after the limiter", i, d.Policy)
+				}
+			}
+
+			d := rl.CheckUserLimit("alice", 1)
+			if !d.Denied() {
+				t.Fatalf("got %+v with the limit used up, want the request denied", d)
+			}
+			if d.Remaining != 0 || d.RetryAfter <= 0 {
+				t.Errorf("got %d remaining and retry after %s, want nothing left and a retry time", d.Remaining, d.RetryAfter)
+			}
+			if !d.ResetAt.After(time.Now()) {
+				t.Errorf("got reset at %s, want it in the future", d.ResetAt)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package ratelimiter
+
+import (
+	"expvar"
+	"fmt"
+
+	"github.com/Zanda256/rate-limiter-go/business/data/cache"
+)
+
+// Ways a tier can treat requests whose limit couldn't be checked, for
+// example because the store is unreachable or its circuit breaker is open.
+const (
+	// FailClosed fails the request. It is the default.
+	FailClosed = "closed"
+	// FailOpen admits the request.
+	FailOpen = "open"
+	// FailLocal checks the request against a limiter kept in memory, which
+	// enforces a fraction of the tier's limits since every instance of the
+	// service enforces its own.
+	FailLocal = "local"
+)
+
+// DefaultFallbackPercent is the share of the tier's limits a local fallback
+// enforces when the tier doesn't set one.
+const DefaultFallbackPercent = 50
+
+// fallbackMaxKeys bounds the number of keys a local fallback keeps, so that
+// an outage can't exhaust memory.
+const fallbackMaxKeys = 100_000
+
+// failureMetrics is published at /debug/vars. It counts the requests whose
+// limit couldn't be checked by how they were treated.
+var failureMetrics = expvar.NewMap("limiterFailures")
+
+// FallbackPercentOrDefault returns the share of the tier's limits a local
+// fallback enforces, in percent.
+func (t Tier) FallbackPercentOrDefault() int {
+	if t.FallbackPercent == 0 {
+		return DefaultFallbackPercent
+	}
+	return t.FallbackPercent
+}
+
+// scaled returns the tier with its limits cut down to percent of their size,
+// never below a single unit.
+func (t Tier) scaled(percent int) Tier {
+	scale := func(n int) int {
+		if n == 0 {
+			return 0
+		}
+		return max(1, n*percent/100)
+	}
+
+	// Tiers that set neither fall back on the default capacity for their rate
+	// and burst too.
+	if t.Capacity == 0 && t.Rate == 0 {
+		t.Capacity = DefaultRateLimitCapacity
+	}
+	t.Capacity = scale(t.Capacity)
+	t.Rate = scale(t.Rate)
+	t.Burst = scale(t.Burst)
+
+	limits := make([]Limit, len(t.Limits))
+	for i, l := range t.Limits {
+		l.Capacity = scale(l.Capacity)
+		limits[i] = l
+	}
+	t.Limits = limits
+
+	return t
+}
+
+// newFallback builds the limiter a tier falls back to. Tiers that don't fall
+// back to a local limiter get nil.
+func newFallback(factory Factory, cfg RateLimiterConfig) (Limiter, error) {
+	switch cfg.Tier.OnFailure {
+	case "", FailClosed, FailOpen:
+		return nil, nil
+	case FailLocal:
+	default:
+		return nil, fmt.Errorf("unknown failure mode %q", cfg.Tier.OnFailure)
+	}
+
+	percent := cfg.Tier.FallbackPercentOrDefault()
+	if percent < 1 || percent > 100 {
+		return nil, fmt.Errorf("fallback percent %d must be between 1 and 100", percent)
+	}
+
+	cfg.Tier = cfg.Tier.scaled(percent)
+	cfg.KvStore = cache.NewMemoryCache(cache.MemoryConfig{
+		MaxKeys: fallbackMaxKeys,
+	})
+	return factory(cfg)
+}
+
+// failover decides a request whose limit couldn't be checked according to
+// the failure mode of the tier. The RefundFunc gives back the units a local
+// fallback consumed.
+func (rl *RateLimiterImpl) failover(userID string, cost int, d Decision) (Decision, RefundFunc) {
+	switch rl.OnFailure {
+	case FailOpen:
+		failureMetrics.Add(FailOpen, 1)
+		return Decision{
+			Allowed: true,
+			Policy:  "fail-open",
+		}, nil
+
+	case FailLocal:
+		failureMetrics.Add(FailLocal, 1)
+		fd := rl.Fallback.Accept(userID, cost)
+		if fd.Policy == "" {
+			fd.Policy = "local"
+		} else {
+			fd.Policy = "local:" + fd.Policy
+		}
+		return fd, refundFor(rl.Fallback, userID, cost, fd)
+
+	default:
+		failureMetrics.Add(FailClosed, 1)
+		return d, nil
+	}
+}
+
+// TolerateFailure reports whether a request of the tier may go ahead when a
+// check made on top of its limit, like a ban, failed. Only tiers that fail
+// closed fail the request; there is no local fallback for such checks, so
+// tiers that fail over to one skip them like tiers that fail open, and still
+// enforce their own limit. The failure is counted in the failure metrics.
+func (rl *RateLimiterImpl) TolerateFailure() bool {
+	switch rl.OnFailure {
+	case FailOpen, FailLocal:
+		failureMetrics.Add(rl.OnFailure, 1)
+		return true
+	default:
+		failureMetrics.Add(FailClosed, 1)
+		return false
+	}
+}
@@ -0,0 +1,70 @@
+package ratelimiter_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Zanda256/rate-limiter-go/business/data/cache"
+	ratelimiter "github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter"
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestOnFailure(t *testing.T) {
+	tests := []struct {
+		onFailure string
+		allowed   int
+		policy    string
+	}{
+		{onFailure: ratelimiter.FailClosed},
+		{onFailure: ratelimiter.FailOpen, allowed: 5, policy: "fail-open"},
+		{onFailure: ratelimiter.FailLocal, allowed: 2, policy: "local"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.onFailure, func(t *testing.T) {
+			mr := miniredis.RunT(t)
+			store, err := cache.NewRedisCache(cache.RedisConfig{Addrs: []string{mr.Addr()}})
+			if err != nil {
+				t.Fatalf("connecting to redis: %s", err)
+			}
+			mr.Close()
+
+			// The local fallback enforces half of the tier's capacity.
+			rl, err := ratelimiter.NewRateLimiter(ratelimiter.RateLimiterConfig{
+				Name:    "basic",
+				Tier:    ratelimiter.Tier{Algo: ratelimiter.FixedWindow, Period: 60, Capacity: 4, OnFailure: tt.onFailure},
+				KvStore: store,
+				Log:     newLogger(),
+			})
+			if err != nil {
+				t.Fatalf("constructing limiter: %s", err)
+			}
+
+			for i := 1; i <= 5; i++ {
+				d := rl.CheckUserLimit("alice", 1)
+				if tt.onFailure == ratelimiter.FailClosed {
+					if d.Allowed || d.Err == nil {
+						t.Fatalf("request %d: got %+v, want the store error", i, d)
+					}
+					continue
+				}
+				if want := i <= tt.allowed; d.Allowed != want || d.Err != nil {
+					t.Fatalf("request %d: got %+v, want allowed %t", i, d, want)
+				}
+				if !strings.Contains(d.Policy, tt.policy) {
+					t.Errorf("request %d: got policy %q, want %q", i, d.Policy, tt.policy)
+				}
+			}
+		})
+	}
+}
+
+func TestOnFailureUnknown(t *testing.T) {
+	_, err := ratelimiter.NewRateLimiter(ratelimiter.RateLimiterConfig{
+		Tier:    ratelimiter.Tier{OnFailure: "sometimes"},
+		KvStore: newRedis(t),
+		Log:     newLogger(),
+	})
+	if err == nil {
+		t.Errorf("got no error for an unknown failure mode")
+	}
+}
@@ -0,0 +1,294 @@
+package fairshare
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Zanda256/rate-limiter-go/business/data/cache"
+	"github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter/decision"
+	"github.com/Zanda256/rate-limiter-go/foundation/logger"
+)
+
+// fairShareScript tracks the active users of a budget and admits a request if
+// it fits in the user's share of it, or if the budget left once it is taken
+// still covers what the other users of the window haven't used of theirs.
+//
+//	KEYS[1] active users, scored by when they were last seen in milliseconds
+//	KEYS[2] weights of the active users
+//	KEYS[3] total weight of the active users
+//	KEYS[4] usage of every user in the current window
+//	ARGV[1] now, unix time in milliseconds
+//	ARGV[2] users last seen before this unix time in milliseconds are inactive
+//	ARGV[3] user
+//	ARGV[4] weight of the user
+//	ARGV[5] cost of the request
+//	ARGV[6] budget shared by all users every window
+//	ARGV[7] ttl of the usage, in seconds
+//	ARGV[8] ttl of the active user tracking, in seconds
+//
+// It returns {1, share, units left} when the request is admitted, or
+// {0, share, units left} when it isn't.
+var fairShareScript = cache.NewScript(`
+local user = ARGV[3]
+local weight = tonumber(ARGV[4])
+local cost = tonumber(ARGV[5])
+local budget = tonumber(ARGV[6])
+
+local stale = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", "(" .. ARGV[2])
+for _, m in ipairs(stale) do
+	redis.call("DECRBY", KEYS[3], redis.call("HGET", KEYS[2], m) or "0")
+	redis.call("HDEL", KEYS[2], m)
+end
+if #stale > 0 then
+	redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", "(" .. ARGV[2])
+end
+
+local old = tonumber(redis.call("HGET", KEYS[2], user) or "0")
+if old ~= weight then
+	redis.call("INCRBY", KEYS[3], weight - old)
+	redis.call("HSET", KEYS[2], user, weight)
+end
+redis.call("ZADD", KEYS[1], ARGV[1], user)
+for i = 1, 3 do
+	redis.call("EXPIRE", KEYS[i], ARGV[8])
+end
+
+local total = tonumber(redis.call("GET", KEYS[3]))
+local share = math.max(1, math.floor(budget * weight / total))
+local used = 0
+local spent = 0
+local owed = 0
+local usage = redis.call("HGETALL", KEYS[4])
+for i = 1, #usage, 2 do
+	local u = tonumber(usage[i+1])
+	spent = spent + u
+	if usage[i] == user then
+		used = u
+	else
+		local w = redis.call("HGET", KEYS[2], usage[i])
+		if w then
+			local s = math.max(1, math.floor(budget * tonumber(w) / total))
+			if s > u then
+				owed = owed + s - u
+			end
+		end
+	end
+end
+
+if spent + cost > budget or (used + cost > share and spent + cost > budget - owed) then
+	return {0, share, math.min(budget - spent, math.max(share - used, budget - owed - spent))}
+end
+
+redis.call("HINCRBY", KEYS[4], user, cost)
+redis.call("EXPIRE", KEYS[4], ARGV[7])
+used = used + cost
+spent = spent + cost
+return {1, share, math.min(budget - spent, math.max(share - used, budget - owed - spent))}
+`)
+
+// refundScript gives units back to a user's usage in a window, never going
+// below zero.
+//
+//	KEYS[1] usage of every user in the window
+//	ARGV[1] user
+//	ARGV[2] units to give back
+var refundScript = cache.NewScript(`
+local used = tonumber(redis.call("HGET", KEYS[1], ARGV[1]) or "0")
+if used > 0 then
+	redis.call("HSET", KEYS[1], ARGV[1], math.max(0, used - tonumber(ARGV[2])))
+end
+return 0
+`)
+
+// Controller divides a budget of Budget units every Period seconds among the
+// users that are currently active, in proportion to their weights. Users are
+// active from their first request until they have been quiet for a period,
+// so a user's share shrinks as others join and grows as they leave. Shares
+// are only enforced once the budget is contended: a user may go past its
+// share as long as the budget left still covers what the other users that
+// made requests in the window haven't used of theirs. Active users are
+// tracked in the store, so every instance agrees on the shares.
+type Controller struct {
+	Log    *logger.Logger
+	Store  cache.Store
+	Scope  string
+	Period int
+	Budget int
+}
+
+type ControllerConfig struct {
+	Log    *logger.Logger
+	Store  cache.Store
+	Scope  string
+	Period int
+	Budget int
+}
+
+func NewController(cfg ControllerConfig) *Controller {
+	return &Controller{
+		Log:    cfg.Log,
+		Store:  cfg.Store,
+		Scope:  cfg.Scope,
+		Period: cfg.Period,
+		Budget: cfg.Budget,
+	}
+}
+
+// Accept reports whether the user's request, costing cost units, fits in the
+// user's share of the budget or in what the other users don't need of it,
+// consuming it if so. The decision's limit is the user's share at the time of
+// the request, and its remaining units are those the user may still take.
+func (c *Controller) Accept(userID string, weight int, cost int) decision.Decision {
+	now := time.Now()
+	size := time.Duration(c.Period) * time.Second
+	windowID := now.UnixNano() / int64(size)
+	resetAt := time.Unix(0, (windowID+1)*int64(size))
+
+	allowed, share, left, err := c.take(userID, weight, cost, now, windowID)
+	if err != nil {
+		c.Log.Error(context.Background(), fmt.Sprintf("fair share: %s", err.Error()))
+		return decision.Error(err)
+	}
+
+	d := decision.Decision{
+		Allowed:   allowed,
+		Limit:     int(share),
+		Remaining: max(0, int(left)),
+		ResetAt:   resetAt,
+	}
+	if !d.Allowed {
+		c.Log.Info(context.Background(), "fair share exhausted", "userID", userID, "share", share)
+		d.RetryAfter = time.Until(resetAt)
+	}
+	return d
+}
+
+// take returns whether the request was admitted, the user's share and the
+// units the user may still take. Without scripts the whole state of the scope is kept in a
+// single value.
+func (c *Controller) take(userID string, weight int, cost int, now time.Time, windowID int64) (bool, int64, int64, error) {
+	sr, ok := c.Store.(cache.ScriptRunner)
+	if !ok {
+		return c.takeCAS(userID, weight, cost, now, windowID)
+	}
+
+	keys := []string{
+		fmt.Sprintf("fairshare:{%s}:active", c.Scope),
+		fmt.Sprintf("fairshare:{%s}:weights", c.Scope),
+		fmt.Sprintf("fairshare:{%s}:weight", c.Scope),
+		c.usageKey(windowID),
+	}
+
+	size := time.Duration(c.Period) * time.Second
+	res, err := sr.RunScript(context.Background(), fairShareScript, keys,
+		now.UnixMilli(), now.Add(-size).UnixMilli(), userID, weight, cost, c.Budget, 2*c.Period, 2*c.Period)
+	if err != nil {
+		return false, 0, 0, err
+	}
+
+	vals, ok := res.([]any)
+	if !ok || len(vals) != 3 {
+		return false, 0, 0, errors.New("unexpected script result")
+	}
+	allowed, ok1 := vals[0].(int64)
+	share, ok2 := vals[1].(int64)
+	left, ok3 := vals[2].(int64)
+	if !ok1 || !ok2 || !ok3 {
+		return false, 0, 0, errors.New("unexpected script result")
+	}
+	return allowed == 1, share, left, nil
+}
+
+// Refund gives cost units back to the user's share and to the budget of the
+// current window.
+func (c *Controller) Refund(userID string, cost int) error {
+	size := time.Duration(c.Period) * time.Second
+	windowID := time.Now().UnixNano() / int64(size)
+
+	if sr, ok := c.Store.(cache.ScriptRunner); ok {
+		_, err := sr.RunScript(context.Background(), refundScript, []string{c.usageKey(windowID)}, userID, cost)
+		return err
+	}
+
+	var st state
+	return cache.UpdateJSON(context.Background(), c.Store, fmt.Sprintf("fairshare:{%s}", c.Scope), 0, &st,
+		func(st *state) (bool, error) {
+			if st.Window != windowID || st.Used[userID] == 0 {
+				return false, nil
+			}
+			st.Used[userID] = max(0, st.Used[userID]-cost)
+			st.Spent = max(0, st.Spent-cost)
+			return true, nil
+		})
+}
+
+// usageKey returns the key of the usage of every user in a window.
+func (c *Controller) usageKey(windowID int64) string {
+	return fmt.Sprintf("fairshare:{%s}:%d", c.Scope, windowID)
+}
+
+type activeUser struct {
+	Weight int   `json:"weight"`
+	Seen   int64 `json:"seen"`
+}
+
+type state struct {
+	Active map[string]activeUser `json:"active"`
+	Window int64                 `json:"window"`
+	Used   map[string]int        `json:"used"`
+	Spent  int                   `json:"spent"`
+}
+
+func (c *Controller) takeCAS(userID string, weight int, cost int, now time.Time, windowID int64) (bool, int64, int64, error) {
+	size := time.Duration(c.Period) * time.Second
+	cutoff := now.Add(-size).UnixMilli()
+
+	var allowed bool
+	var share, left int64
+	var st state
+	err := cache.UpdateJSON(context.Background(), c.Store, fmt.Sprintf("fairshare:{%s}", c.Scope), 2*size, &st,
+		func(st *state) (bool, error) {
+			if st.Active == nil {
+				st.Active = make(map[string]activeUser)
+			}
+			if st.Used == nil || st.Window != windowID {
+				st.Window, st.Used, st.Spent = windowID, make(map[string]int), 0
+			}
+
+			total := 0
+			for id, u := range st.Active {
+				if u.Seen < cutoff {
+					delete(st.Active, id)
+					continue
+				}
+				if id != userID {
+					total += u.Weight
+				}
+			}
+			st.Active[userID] = activeUser{Weight: weight, Seen: now.UnixMilli()}
+			total += weight
+
+			var owed int
+			for id, u := range st.Used {
+				if a, ok := st.Active[id]; ok && id != userID {
+					owed += max(0, max(1, c.Budget*a.Weight/total)-u)
+				}
+			}
+
+			share = max(1, int64(c.Budget*weight/total))
+			used := st.Used[userID]
+			allowed = st.Spent+cost <= c.Budget &&
+				(int64(used+cost) <= share || st.Spent+cost <= c.Budget-owed)
+			if allowed {
+				st.Used[userID] += cost
+				st.Spent += cost
+			}
+			left = min(int64(c.Budget-st.Spent), max(share-int64(st.Used[userID]), int64(c.Budget-owed-st.Spent)))
+			// Still record that the user is active when the request is
+			// denied.
+			return true, nil
+		})
+	return allowed, share, left, err
+}
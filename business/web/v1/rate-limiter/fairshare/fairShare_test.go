@@ -0,0 +1,89 @@
+package fairshare_test
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/Zanda256/rate-limiter-go/business/data/cache"
+	"github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter/fairshare"
+	"github.com/Zanda256/rate-limiter-go/foundation/logger"
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestAccept(t *testing.T) {
+	store, err := cache.NewRedisCache(cache.RedisConfig{Addrs: []string{miniredis.RunT(t).Addr()}})
+	if err != nil {
+		t.Fatalf("connecting to redis: %s", err)
+	}
+
+	c := fairshare.NewController(fairshare.ControllerConfig{
+		Log:    logger.New(io.Discard, logger.LevelError, "TEST", func(context.Context) string { return "" }),
+		Store:  store,
+		Scope:  "test",
+		Period: 60,
+		Budget: 12,
+	})
+
+	// Alone, alice gets the whole budget.
+	d := c.Accept("alice", 1, 2)
+	if !d.Allowed || d.Limit != 12 || d.Remaining != 10 {
+		t.Fatalf("alice alone: got %+v, want 10 of 12 left", d)
+	}
+
+	// Once bob, weighing twice as much, is active, bob gets two thirds of it
+	// and alice a third.
+	d = c.Accept("bob", 2, 6)
+	if !d.Allowed || d.Limit != 8 || d.Remaining != 2 {
+		t.Fatalf("bob: got %+v, want 2 of 8 left", d)
+	}
+	d = c.Accept("alice", 1, 2)
+	if !d.Allowed || d.Limit != 4 || d.Remaining != 0 {
+		t.Fatalf("alice with bob: got %+v, want 0 of 4 left", d)
+	}
+
+	// The budget is contended: what is left of it is owed to bob.
+	d = c.Accept("alice", 1, 1)
+	if d.Allowed || d.Err != nil {
+		t.Fatalf("alice over the share: got %+v, want the request denied", d)
+	}
+	if d.Remaining != 0 || d.RetryAfter <= 0 {
+		t.Errorf("alice over the share: got %+v, want nothing left and a retry time", d)
+	}
+	if d = c.Accept("bob", 2, 2); !d.Allowed {
+		t.Errorf("bob: got %+v, want the rest of the share allowed", d)
+	}
+}
+
+func TestAcceptUncontended(t *testing.T) {
+	store, err := cache.NewRedisCache(cache.RedisConfig{Addrs: []string{miniredis.RunT(t).Addr()}})
+	if err != nil {
+		t.Fatalf("connecting to redis: %s", err)
+	}
+
+	c := fairshare.NewController(fairshare.ControllerConfig{
+		Log:    logger.New(io.Discard, logger.LevelError, "TEST", func(context.Context) string { return "" }),
+		Store:  store,
+		Scope:  "test",
+		Period: 1,
+		Budget: 12,
+	})
+
+	// Both users are active halfway through a window, and still are at the
+	// start of the next one.
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(1500 * time.Millisecond)))
+	c.Accept("alice", 1, 1)
+	c.Accept("bob", 1, 1)
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+
+	// Bob makes no request in the new window, so alice may use all of it.
+	for i := 1; i <= 12; i++ {
+		if d := c.Accept("alice", 1, 1); !d.Allowed {
+			t.Fatalf("request %d: got %+v, want allowed past the share", i, d)
+		}
+	}
+	if d := c.Accept("alice", 1, 1); d.Allowed {
+		t.Errorf("got %+v with the budget used up, want denied", d)
+	}
+}
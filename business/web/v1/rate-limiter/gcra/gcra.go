@@ -0,0 +1,305 @@
+package gcra
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/Zanda256/rate-limiter-go/business/data/cache"
+	"github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter/decision"
+	"github.com/Zanda256/rate-limiter-go/foundation/logger"
+)
+
+const keyPrefix = "gcra:"
+
+// gcraScript implements the generic cell rate algorithm. The only state kept
+// per key is the theoretical arrival time (TAT) in microseconds.
+//
+//	KEYS[1] key
+//	ARGV[1] now, in microseconds
+//	ARGV[2] emission interval, in microseconds
+//	ARGV[3] burst tolerance, in microseconds
+//	ARGV[4] cost of the request
+//
+// It returns {1, 0, TAT} when the request conforms, or {0, retry after in
+// microseconds, TAT} when it doesn't.
+var gcraScript = cache.NewScript(`
+local now = tonumber(ARGV[1])
+local emission = tonumber(ARGV[2])
+local tolerance = tonumber(ARGV[3])
+local increment = emission * tonumber(ARGV[4])
+
+local tat = tonumber(redis.call("GET", KEYS[1]))
+if tat == nil or tat < now then
+	tat = now
+end
+
+local newTat = tat + increment
+local allowAt = newTat - emission - tolerance
+if now < allowAt then
+	return {0, allowAt - now, tat}
+end
+
+redis.call("SET", KEYS[1], string.format("%.0f", newTat), "PX", math.ceil((newTat - now) / 1000))
+return {1, 0, newTat}
+`)
+
+// reserveScript takes cost units whether or not they conform yet, pushing the
+// TAT into the future as far as needed.
+//
+//	KEYS[1] key
+//	ARGV[1] now, in microseconds
+//	ARGV[2] increment of the TAT, in microseconds
+//
+// It returns the new TAT.
+var reserveScript = cache.NewScript(`
+local now = tonumber(ARGV[1])
+local tat = tonumber(redis.call("GET", KEYS[1]))
+if tat == nil or tat < now then
+	tat = now
+end
+
+tat = tat + tonumber(ARGV[2])
+redis.call("SET", KEYS[1], string.format("%.0f", tat), "PX", math.ceil((tat - now) / 1000))
+return tat
+`)
+
+// cancelScript gives back units taken by a reservation by moving the TAT back.
+//
+//	KEYS[1] key
+//	ARGV[1] now, in microseconds
+//	ARGV[2] decrement of the TAT, in microseconds
+var cancelScript = cache.NewScript(`
+local now = tonumber(ARGV[1])
+local tat = tonumber(redis.call("GET", KEYS[1]))
+if tat == nil then
+	return 0
+end
+
+tat = tat - tonumber(ARGV[2])
+if tat <= now then
+	redis.call("DEL", KEYS[1])
+else
+	redis.call("SET", KEYS[1], string.format("%.0f", tat), "PX", math.ceil((tat - now) / 1000))
+end
+return 0
+`)
+
+// Controller limits users to Capacity requests every Period seconds, spread
+// evenly, while tolerating bursts of up to Burst requests.
+type Controller struct {
+	Log      *logger.Logger
+	Store    cache.Store
+	Period   int
+	Capacity int
+	Burst    int
+}
+
+type ControllerConfig struct {
+	Log      *logger.Logger
+	Store    cache.Store
+	Period   int
+	Capacity int
+	Burst    int
+}
+
+func NewController(cfg ControllerConfig) *Controller {
+	burst := cfg.Burst
+	if burst < 1 {
+		burst = cfg.Capacity
+	}
+	return &Controller{
+		Log:      cfg.Log,
+		Store:    cfg.Store,
+		Period:   cfg.Period,
+		Capacity: cfg.Capacity,
+		Burst:    burst,
+	}
+}
+
+// emissionInterval is the time between two conforming requests at the
+// sustained rate.
+func (c *Controller) emissionInterval() time.Duration {
+	return time.Duration(c.Period) * time.Second / time.Duration(c.Capacity)
+}
+
+// Accept reports whether the user's request, costing cost units, conforms to
+// the limit. A denied request's decision carries the exact time until it
+// would conform.
+func (c *Controller) Accept(userID string, cost int) decision.Decision {
+	if cost > c.Burst {
+		c.Log.Info(context.Background(), "cost exceeds burst", "userID", userID, "cost", cost)
+		return decision.Decision{Limit: c.Burst}
+	}
+
+	now := time.Now()
+	emission := c.emissionInterval()
+	tolerance := emission * time.Duration(c.Burst-1)
+
+	allowed, retryAfter, tat, err := c.conform(keyPrefix+userID, now, emission, tolerance, cost)
+	if err != nil {
+		c.Log.Error(context.Background(), fmt.Sprintf("gcra: %s", err.Error()))
+		return decision.Error(err)
+	}
+	if !allowed {
+		c.Log.Info(context.Background(), "gcra limit reached", "userID", userID, "retryAfter", retryAfter.String())
+	}
+
+	// Another k requests conform now as long as tat + k*emission - emission -
+	// tolerance <= now.
+	remaining := int(math.Floor(float64(now.Sub(tat))/float64(emission))) + c.Burst
+	remaining = min(max(remaining, 0), c.Burst)
+
+	return decision.Decision{
+		Allowed:    allowed,
+		Limit:      c.Burst,
+		Remaining:  remaining,
+		ResetAt:    tat,
+		RetryAfter: retryAfter,
+	}
+}
+
+// Reserve takes cost units from the user's limit ahead of time and returns
+// how long the caller has to wait before the request conforms.
+func (c *Controller) Reserve(userID string, cost int) (time.Duration, error) {
+	if cost > c.Burst {
+		return 0, fmt.Errorf("cost %d exceeds burst of %d", cost, c.Burst)
+	}
+
+	now := time.Now()
+	emission := c.emissionInterval()
+
+	increment := (emission * time.Duration(cost)).Microseconds()
+
+	var tat int64
+	if sr, ok := c.Store.(cache.ScriptRunner); ok {
+		res, err := sr.RunScript(context.Background(), reserveScript, []string{keyPrefix + userID},
+			now.UnixMicro(), increment)
+		if err != nil {
+			return 0, fmt.Errorf("reserve script: %w", err)
+		}
+		if tat, ok = res.(int64); !ok {
+			return 0, errors.New("reserve script: unexpected script result")
+		}
+	} else {
+		err := c.updateTAT(keyPrefix+userID, now, func(cur int64, found bool) (int64, bool) {
+			tat = max(cur, now.UnixMicro()) + increment
+			return tat, true
+		})
+		if err != nil {
+			return 0, fmt.Errorf("reserve: %w", err)
+		}
+	}
+
+	// The request conforms once tat - burst*emission has passed.
+	allowAt := time.UnixMicro(tat).Add(-emission * time.Duration(c.Burst))
+	return max(0, allowAt.Sub(now)), nil
+}
+
+// CancelReservation gives back cost units reserved for the user.
+func (c *Controller) CancelReservation(userID string, cost int) error {
+	now := time.Now()
+	decrement := (c.emissionInterval() * time.Duration(cost)).Microseconds()
+
+	sr, ok := c.Store.(cache.ScriptRunner)
+	if !ok {
+		return c.updateTAT(keyPrefix+userID, now, func(tat int64, found bool) (int64, bool) {
+			if !found {
+				return 0, false
+			}
+			return max(tat-decrement, now.UnixMicro()), true
+		})
+	}
+
+	_, err := sr.RunScript(context.Background(), cancelScript, []string{keyPrefix + userID},
+		now.UnixMicro(), decrement)
+	if err != nil {
+		return fmt.Errorf("cancel script: %w", err)
+	}
+	return nil
+}
+
+// Refund gives cost units back by moving the TAT back, like
+// CancelReservation.
+func (c *Controller) Refund(userID string, cost int) error {
+	return c.CancelReservation(userID, cost)
+}
+
+// conform checks a request against the TAT stored at key, moving the TAT
+// forward when the request conforms.
+func (c *Controller) conform(key string, now time.Time, emission, tolerance time.Duration, cost int) (bool, time.Duration, time.Time, error) {
+	if sr, ok := c.Store.(cache.ScriptRunner); ok {
+		res, err := sr.RunScript(context.Background(), gcraScript, []string{key},
+			now.UnixMicro(), emission.Microseconds(), tolerance.Microseconds(), cost)
+		if err != nil {
+			return false, 0, time.Time{}, err
+		}
+		return parseResult(res)
+	}
+
+	var allowed bool
+	var retryAfter, tat int64
+	err := c.updateTAT(key, now, func(cur int64, found bool) (int64, bool) {
+		tat = max(cur, now.UnixMicro())
+		newTat := tat + emission.Microseconds()*int64(cost)
+		allowAt := newTat - emission.Microseconds() - tolerance.Microseconds()
+		if now.UnixMicro() < allowAt {
+			allowed, retryAfter = false, allowAt-now.UnixMicro()
+			return 0, false
+		}
+		allowed, retryAfter, tat = true, 0, newTat
+		return newTat, true
+	})
+	if err != nil {
+		return false, 0, time.Time{}, err
+	}
+	return allowed, time.Duration(retryAfter) * time.Microsecond, time.UnixMicro(tat), nil
+}
+
+// updateTAT replaces the TAT stored at key, in microseconds, with the one fn
+// computes from it. fn returns false to leave it alone. The key lives until
+// the new TAT has passed.
+func (c *Controller) updateTAT(key string, now time.Time, fn func(tat int64, found bool) (int64, bool)) error {
+	var newTat int64
+	ttl := 2 * c.emissionInterval() * time.Duration(c.Burst)
+
+	err := cache.Update(context.Background(), c.Store, key, ttl, func(cur string, found bool) (string, bool, error) {
+		var tat int64
+		if found {
+			var err error
+			if tat, err = strconv.ParseInt(cur, 10, 64); err != nil {
+				return "", false, err
+			}
+		}
+
+		var write bool
+		newTat, write = fn(tat, found)
+		return strconv.FormatInt(newTat, 10), write, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Reservations can push the TAT further out than the usual ttl.
+	if live := time.UnixMicro(newTat).Sub(now); live > ttl {
+		return c.Store.Expire(context.Background(), key, live)
+	}
+	return nil
+}
+
+func parseResult(res any) (bool, time.Duration, time.Time, error) {
+	vals, ok := res.([]any)
+	if !ok || len(vals) != 3 {
+		return false, 0, time.Time{}, errors.New("unexpected script result")
+	}
+	allowed, ok1 := vals[0].(int64)
+	retryAfter, ok2 := vals[1].(int64)
+	tat, ok3 := vals[2].(int64)
+	if !ok1 || !ok2 || !ok3 {
+		return false, 0, time.Time{}, errors.New("unexpected script result")
+	}
+	return allowed == 1, time.Duration(retryAfter) * time.Microsecond, time.UnixMicro(tat), nil
+}
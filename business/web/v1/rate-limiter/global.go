@@ -0,0 +1,118 @@
+package ratelimiter
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Zanda256/rate-limiter-go/business/data/cache"
+	"github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter/fairshare"
+	"github.com/Zanda256/rate-limiter-go/foundation/logger"
+)
+
+// GlobalConfig declares a limit shared by every caller of a route, for example
+// 5000 requests a second across all users. Scope names the limit and keys its
+// state, so instances that share a scope share the limit.
+//
+// With FairShare, the tier's capacity is instead divided every period among
+// the callers that are currently active, in proportion to the weight of their
+// tier. Tiers missing from Weights weigh 1. Shares only bind once the capacity
+// is contended, so the callers of a period may use what the others don't need.
+// The tier's algorithm is then only used by a local fallback, when the shares
+// can't be checked and the tier fails over to one.
+type GlobalConfig struct {
+	Scope     string         `json:"scope"`
+	Tier      Tier           `json:"tier"`
+	FairShare bool           `json:"fairShare,omitempty"`
+	Weights   map[string]int `json:"weights,omitempty"`
+}
+
+// GlobalLimit enforces a service wide ceiling on top of the per caller limits,
+// so that a flood of distinct callers can't overwhelm the backend. The limiter
+// enforces the ceiling, or under fair sharing, treats the requests whose
+// share couldn't be checked according to the tier's failure mode.
+type GlobalLimit struct {
+	key     string
+	limiter *RateLimiterImpl
+	fair    *fairshare.Controller
+	weights map[string]int
+}
+
+type GlobalLimitConfig struct {
+	Global  GlobalConfig
+	KvStore cache.Store
+	Log     *logger.Logger
+}
+
+// NewGlobalLimit builds the limiter of the global limit. Algorithms that
+// implement Observer are rejected, as only the limiter of the caller's tier is
+// told how the request fared.
+func NewGlobalLimit(cfg GlobalLimitConfig) (*GlobalLimit, error) {
+	if cfg.Global.Scope == "" {
+		return nil, errors.New("global limit: scope is required")
+	}
+
+	rl, err := NewRateLimiter(RateLimiterConfig{
+		Name:    "global",
+		Tier:    cfg.Global.Tier,
+		KvStore: cfg.KvStore,
+		Log:     cfg.Log,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("global limit: %w", err)
+	}
+	if _, ok := rl.Limiter.(Observer); ok {
+		return nil, fmt.Errorf("global limit: the %s algorithm needs admitted requests to be observed, it can't be global", rl.Algo)
+	}
+
+	g := GlobalLimit{
+		key:     "global:" + cfg.Global.Scope,
+		limiter: rl,
+	}
+	if !cfg.Global.FairShare {
+		return &g, nil
+	}
+
+	for tier, w := range cfg.Global.Weights {
+		if w < 1 {
+			return nil, fmt.Errorf("global limit: weight of tier %q must be positive", tier)
+		}
+	}
+	g.fair = fairshare.NewController(fairshare.ControllerConfig{
+		Store:  cfg.KvStore,
+		Log:    cfg.Log,
+		Scope:  cfg.Global.Scope,
+		Period: cfg.Global.Tier.PeriodOrDefault(),
+		Budget: cfg.Global.Tier.CapacityOrDefault(),
+	})
+	g.weights = cfg.Global.Weights
+
+	return &g, nil
+}
+
+// Check consumes cost units from the global limit. Under fair sharing the
+// units come from the share of the identity, weighted by its tier; when the
+// shares can't be checked, the request is treated according to the failure
+// mode of the global tier. The RefundFunc gives the units of an admitted
+// request back.
+func (g *GlobalLimit) Check(identity string, tier string, cost int) (Decision, RefundFunc) {
+	if g.fair == nil {
+		return g.limiter.Admit(g.key, cost)
+	}
+
+	weight, ok := g.weights[tier]
+	if !ok {
+		weight = 1
+	}
+	d := g.fair.Accept(identity, weight, cost)
+	if d.Err != nil {
+		d, refund := g.limiter.failover(g.key, cost, d)
+		return g.limiter.named(d), refund
+	}
+	d.Policy = "global"
+	if !d.Allowed {
+		return d, nil
+	}
+	return d, func() error {
+		return g.fair.Refund(identity, cost)
+	}
+}
@@ -0,0 +1,143 @@
+package ratelimiter_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	ratelimiter "github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter"
+)
+
+func TestGlobalLimit(t *testing.T) {
+	store := newRedis(t)
+	newGlobal := func(scope string) *ratelimiter.GlobalLimit {
+		t.Helper()
+		g, err := ratelimiter.NewGlobalLimit(ratelimiter.GlobalLimitConfig{
+			Global: ratelimiter.GlobalConfig{
+				Scope: scope,
+				Tier:  ratelimiter.Tier{Algo: ratelimiter.FixedWindow, Period: 60, Capacity: 3},
+			},
+			KvStore: store,
+			Log:     newLogger(),
+		})
+		if err != nil {
+			t.Fatalf("constructing global limit: %s", err)
+		}
+		return g
+	}
+
+	// Instances that share a scope share the limit.
+	a, b := newGlobal("api"), newGlobal("api")
+	if d, _ := a.Check("alice", "basic", 2); !d.Allowed {
+		t.Fatalf("first instance: got %+v, want allowed", d)
+	}
+	if d, _ := b.Check("bob", "basic", 1); !d.Allowed {
+		t.Fatalf("second instance: got %+v, want allowed", d)
+	}
+	d, _ := a.Check("alice", "basic", 1)
+	if !d.Denied() {
+		t.Fatalf("got %+v with the limit used up, want denied", d)
+	}
+	if !strings.HasPrefix(d.Policy, "global") {
+		t.Errorf("got policy %q, want the global limit's", d.Policy)
+	}
+
+	if d, _ := newGlobal("other").Check("alice", "basic", 3); !d.Allowed {
+		t.Errorf("other scope: got %+v, want allowed", d)
+	}
+}
+
+func TestGlobalLimitScope(t *testing.T) {
+	_, err := ratelimiter.NewGlobalLimit(ratelimiter.GlobalLimitConfig{
+		Global:  ratelimiter.GlobalConfig{Tier: ratelimiter.Tier{Capacity: 3}},
+		KvStore: newRedis(t),
+		Log:     newLogger(),
+	})
+	if err == nil {
+		t.Errorf("got no error for a global limit without a scope")
+	}
+}
+
+func TestGlobalLimitObserver(t *testing.T) {
+	_, err := ratelimiter.NewGlobalLimit(ratelimiter.GlobalLimitConfig{
+		Global: ratelimiter.GlobalConfig{
+			Scope: "api",
+			Tier:  ratelimiter.Tier{Algo: ratelimiter.Adaptive, Capacity: 10},
+		},
+		KvStore: newRedis(t),
+		Log:     newLogger(),
+	})
+	if err == nil {
+		t.Errorf("got an adaptive global limit, want an error")
+	}
+}
+
+func TestGlobalFairShare(t *testing.T) {
+	g, err := ratelimiter.NewGlobalLimit(ratelimiter.GlobalLimitConfig{
+		Global: ratelimiter.GlobalConfig{
+			Scope:     "api",
+			Tier:      ratelimiter.Tier{Period: 60, Capacity: 12},
+			FairShare: true,
+			Weights:   map[string]int{"premium": 2},
+		},
+		KvStore: newRedis(t),
+		Log:     newLogger(),
+	})
+	if err != nil {
+		t.Fatalf("constructing global limit: %s", err)
+	}
+
+	// The premium caller weighs twice as much as the basic one, so the
+	// budget is split 8 to 4 while both are active. Once both have made
+	// requests, the units left are owed to the premium caller.
+	if d, _ := g.Check("alice", "basic", 1); !d.Allowed {
+		t.Fatalf("alice: got %+v, want allowed", d)
+	}
+	if d, _ := g.Check("bob", "premium", 6); !d.Allowed || d.Limit != 8 {
+		t.Fatalf("bob: got %+v, want allowed with a share of 8", d)
+	}
+	if d, _ := g.Check("alice", "basic", 3); !d.Allowed || d.Limit != 4 {
+		t.Fatalf("alice: got %+v, want allowed with a share of 4", d)
+	}
+	d, _ := g.Check("alice", "basic", 1)
+	if !d.Denied() || d.Policy != "global" {
+		t.Errorf("alice over the share: got %+v, want denied by the global limit", d)
+	}
+	if d, _ := g.Check("bob", "premium", 2); !d.Allowed {
+		t.Errorf("bob: got %+v, want the rest of the share allowed", d)
+	}
+}
+
+func TestGlobalFairShareSingleTier(t *testing.T) {
+	g, err := ratelimiter.NewGlobalLimit(ratelimiter.GlobalLimitConfig{
+		Global: ratelimiter.GlobalConfig{
+			Scope:     "api",
+			Tier:      ratelimiter.Tier{Period: 1, Capacity: 12},
+			FairShare: true,
+			Weights:   map[string]int{"premium": 2},
+		},
+		KvStore: newRedis(t),
+		Log:     newLogger(),
+	})
+	if err != nil {
+		t.Fatalf("constructing global limit: %s", err)
+	}
+
+	// Callers of both tiers are active halfway through a period, and still
+	// are at the start of the next one.
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(1500 * time.Millisecond)))
+	g.Check("alice", "basic", 1)
+	g.Check("bob", "premium", 1)
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+
+	// Only the basic tier makes requests in the new period, so it gets the
+	// whole capacity rather than its share of 4.
+	for i := 1; i <= 12; i++ {
+		if d, _ := g.Check("alice", "basic", 1); !d.Allowed {
+			t.Fatalf("request %d: got %+v, want allowed past the share", i, d)
+		}
+	}
+	if d, _ := g.Check("alice", "basic", 1); !d.Denied() {
+		t.Errorf("got %+v with the capacity used up, want denied", d)
+	}
+}
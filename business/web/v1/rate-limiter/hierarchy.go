@@ -0,0 +1,140 @@
+package ratelimiter
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Zanda256/rate-limiter-go/business/data/cache"
+	"github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter/decision"
+	"github.com/Zanda256/rate-limiter-go/foundation/logger"
+)
+
+// LevelConfig declares one level of a limit hierarchy, for example the user
+// that owns an API key or the organization that owns a user. Owner maps the
+// identity of the level below to the identity of this level; any of the tier
+// resolvers can be used for that.
+type LevelConfig struct {
+	Scope string         `json:"scope"`
+	Tier  Tier           `json:"tier"`
+	Owner ResolverConfig `json:"owner"`
+}
+
+type level struct {
+	scope   string
+	owner   TierResolver
+	limiter *RateLimiterImpl
+}
+
+// Hierarchy enforces the limits of the owners of a caller on top of the
+// caller's own limits. Levels are checked from the most specific to the
+// broadest, so a noisy caller is stopped by its own limit before it eats into
+// the budget its owners share with their other callers.
+type Hierarchy struct {
+	levels []level
+	log    *logger.Logger
+}
+
+type HierarchyConfig struct {
+	Levels  []LevelConfig
+	KvStore cache.Store
+	Log     *logger.Logger
+}
+
+// NewHierarchy builds a limiter and an owner resolver for every level. Levels
+// can't use algorithms that implement Observer, as only the limiter of the
+// caller's tier is told how the request fared.
+func NewHierarchy(cfg HierarchyConfig) (*Hierarchy, error) {
+	levels := make([]level, len(cfg.Levels))
+	for i, lc := range cfg.Levels {
+		if lc.Scope == "" {
+			return nil, fmt.Errorf("level %d: scope is required", i)
+		}
+
+		rc := lc.Owner
+		rc.Store = cfg.KvStore
+		owner, err := NewTierResolver(rc)
+		if err != nil {
+			return nil, fmt.Errorf("level %q: %w", lc.Scope, err)
+		}
+
+		rl, err := NewRateLimiter(RateLimiterConfig{
+			Name:    lc.Scope,
+			Tier:    lc.Tier,
+			KvStore: cfg.KvStore,
+			Log:     cfg.Log,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("level %q: %w", lc.Scope, err)
+		}
+		if _, ok := rl.Limiter.(Observer); ok {
+			return nil, fmt.Errorf("level %q: the %s algorithm needs admitted requests to be observed, it can't limit a level", lc.Scope, rl.Algo)
+		}
+
+		levels[i] = level{
+			scope:   lc.Scope,
+			owner:   owner,
+			limiter: rl,
+		}
+	}
+
+	return &Hierarchy{
+		levels: levels,
+		log:    cfg.Log,
+	}, nil
+}
+
+// Check consumes cost units from every owner of identity. It stops at the
+// first level whose limit is exhausted and returns that level's decision, whose
+// policy starts with the level's scope. Units already consumed from the levels
+// below it are given back, so a request consumes from every level or from
+// none. Resolution stops early when an owner can't be found, or when it fails
+// and the failure mode of the level tolerates that. When every level
+// admits the request, the decision of the broadest level checked is returned,
+// delayed by the longest delay of any level, along with a RefundFunc that
+// gives the units back to every level.
+func (h *Hierarchy) Check(ctx context.Context, r *http.Request, identity string, cost int) (Decision, RefundFunc) {
+	var refunds Refunds
+	d := Decision{Allowed: true}
+	var delay time.Duration
+	id := identity
+	for _, lvl := range h.levels {
+		owner, err := lvl.owner.ResolveTier(ctx, r, id)
+		if err != nil {
+			if !lvl.limiter.TolerateFailure() {
+				h.giveBack(ctx, &refunds)
+				return decision.Error(fmt.Errorf("resolving %s of %q: %w", lvl.scope, id, err)), nil
+			}
+			h.log.Warn(ctx, "owner couldn't be resolved, skipping remaining levels", "scope", lvl.scope,
+				"identity", id, "onFailure", lvl.limiter.OnFailure, "msg", err)
+			break
+		}
+		if owner == "" {
+			h.log.Warn(ctx, "owner not found, skipping remaining levels", "scope", lvl.scope, "identity", id)
+			break
+		}
+
+		// Scope the key so that identities of different levels never share
+		// limiter state.
+		var refund RefundFunc
+		d, refund = lvl.limiter.Admit(lvl.scope+":"+owner, cost)
+		if !d.Allowed {
+			h.giveBack(ctx, &refunds)
+			return d, nil
+		}
+		refunds.Add(refund)
+		delay = max(delay, d.Delay)
+		id = owner
+	}
+	d.Delay = delay
+	return d, refunds.Refund
+}
+
+// giveBack returns the units a request consumed from the levels below the one
+// that turned it away.
+func (h *Hierarchy) giveBack(ctx context.Context, refunds *Refunds) {
+	if err := refunds.Refund(); err != nil {
+		h.log.Error(ctx, "giving back units of lower levels", "msg", err)
+	}
+}
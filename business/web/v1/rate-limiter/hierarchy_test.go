@@ -0,0 +1,67 @@
+package ratelimiter
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Zanda256/rate-limiter-go/business/data/cache"
+)
+
+func TestHierarchyAllOrNone(t *testing.T) {
+	log := newLogger()
+	store := cache.NewMemoryCache(cache.MemoryConfig{})
+	defer store.Close()
+
+	userTier := Tier{Algo: FixedWindow, Period: 60, Capacity: 2}
+	h, err := NewHierarchy(HierarchyConfig{
+		Levels: []LevelConfig{
+			{
+				Scope: "user",
+				Tier:  userTier,
+				Owner: ResolverConfig{Users: map[string]string{"key": "alice"}},
+			},
+			{
+				Scope: "org",
+				Tier:  Tier{Algo: FixedWindow, Period: 60, Capacity: 1},
+				Owner: ResolverConfig{Users: map[string]string{"alice": "acme"}},
+			},
+		},
+		KvStore: store,
+		Log:     log,
+	})
+	if err != nil {
+		t.Fatalf("constructing hierarchy: %s", err)
+	}
+
+	ctx := context.Background()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	d, _ := h.Check(ctx, r, "key", 1)
+	if !d.Allowed {
+		t.Fatalf("first request: got %+v, want it allowed", d)
+	}
+
+	d, refund := h.Check(ctx, r, "key", 1)
+	if d.Allowed || d.Err != nil {
+		t.Fatalf("second request: got %+v, want it denied", d)
+	}
+	if d.Policy != "org" {
+		t.Errorf("second request: got policy %q, want org", d.Policy)
+	}
+	if refund != nil {
+		t.Errorf("second request: got a refund for a denied request")
+	}
+
+	// The user level admitted the second request before the org level
+	// denied it, so it must have been given its unit back.
+	user, err := NewRateLimiter(RateLimiterConfig{Tier: userTier, KvStore: store, Log: log})
+	if err != nil {
+		t.Fatalf("constructing user limiter: %s", err)
+	}
+	d = user.CheckUserLimit("user:alice", 1)
+	if !d.Allowed || d.Remaining != 0 {
+		t.Errorf("user level: got %+v, want its last unit allowed", d)
+	}
+}
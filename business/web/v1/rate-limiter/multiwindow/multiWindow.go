@@ -0,0 +1,250 @@
+package multiwindow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/Zanda256/rate-limiter-go/business/data/cache"
+	"github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter/decision"
+	"github.com/Zanda256/rate-limiter-go/foundation/logger"
+)
+
+// Limit is one of the limits a tier enforces: at most Capacity units every
+// Period seconds.
+type Limit struct {
+	Period   int `json:"period"`
+	Capacity int `json:"capacity"`
+}
+
+// multiWindowScript checks a request against several sliding window counters
+// and only consumes from them when every one of them admits it.
+//
+//	KEYS[2i-1] counter of the current window of limit i
+//	KEYS[2i]   counter of the previous window of limit i
+//	ARGV[1]    cost of the request
+//	ARGV[3i-1] capacity of limit i
+//	ARGV[3i]   elapsed fraction of the current window of limit i
+//	ARGV[3i+1] ttl of the counters of limit i, in seconds
+//
+// It returns {0, index of the tightest limit, units left under it} when the
+// request is admitted, or {i, i, units left under limit i} when limit i is the
+// first to reject it.
+var multiWindowScript = cache.NewScript(`
+local cost = tonumber(ARGV[1])
+local n = #KEYS / 2
+
+local tightest = 0
+local least = nil
+for i = 1, n do
+	local current = tonumber(redis.call("GET", KEYS[2*i-1]) or "0")
+	local previous = tonumber(redis.call("GET", KEYS[2*i]) or "0")
+	local capacity = tonumber(ARGV[3*i-1])
+	local elapsed = tonumber(ARGV[3*i])
+	local left = capacity - (previous * (1 - elapsed) + current)
+	if left < cost then
+		return {i, i, math.max(0, math.floor(left))}
+	end
+	if least == nil or left < least then
+		tightest = i
+		least = left
+	end
+end
+
+for i = 1, n do
+	redis.call("INCRBY", KEYS[2*i-1], cost)
+	redis.call("EXPIRE", KEYS[2*i-1], ARGV[3*i+1])
+end
+return {0, tightest, math.floor(least - cost)}
+`)
+
+// Controller enforces several sliding window counters at once, for example 10
+// requests a second and 1000 an hour. A request is admitted only if every
+// limit admits it, in which case it is counted against all of them; otherwise
+// it is counted against none, in a single atomic step (see cache.Update).
+type Controller struct {
+	Log    *logger.Logger
+	Store  cache.Store
+	Limits []Limit
+}
+
+type ControllerConfig struct {
+	Log    *logger.Logger
+	Store  cache.Store
+	Limits []Limit
+}
+
+// NewController constructs a multi window controller. It fails unless every
+// limit has a positive period and capacity, and a period of its own: limits
+// sharing a period would share their counters.
+func NewController(cfg ControllerConfig) (*Controller, error) {
+	periods := make(map[int]bool, len(cfg.Limits))
+	for _, l := range cfg.Limits {
+		if l.Period < 1 || l.Capacity < 1 {
+			return nil, fmt.Errorf("invalid limit %+v: period and capacity must be positive", l)
+		}
+		if periods[l.Period] {
+			return nil, fmt.Errorf("more than one limit with a period of %ds", l.Period)
+		}
+		periods[l.Period] = true
+	}
+
+	return &Controller{
+		Log:    cfg.Log,
+		Store:  cfg.Store,
+		Limits: cfg.Limits,
+	}, nil
+}
+
+// Accept reports whether the user may make a request costing cost units under
+// every limit. The decision describes the limit that rejected the request or,
+// when it was admitted, the limit with the fewest units left.
+func (c *Controller) Accept(userID string, cost int) decision.Decision {
+	now := time.Now()
+
+	rejectedBy, index, remaining, err := c.check(userID, now, cost)
+	if err != nil {
+		c.Log.Error(context.Background(), fmt.Sprintf("multi window: %s", err.Error()))
+		return decision.Error(err)
+	}
+
+	l := c.Limits[index-1]
+	size := time.Duration(l.Period) * time.Second
+	resetAt := time.Unix(0, (now.UnixNano()/int64(size)+1)*int64(size))
+
+	d := decision.Decision{
+		Allowed:   rejectedBy == 0,
+		Limit:     l.Capacity,
+		Remaining: int(remaining),
+		ResetAt:   resetAt,
+		Policy:    fmt.Sprintf("%d/%ds", l.Capacity, l.Period),
+	}
+	if !d.Allowed {
+		c.Log.Info(context.Background(), "multi window limit reached", "userID", userID,
+			"period", l.Period, "capacity", l.Capacity)
+		d.RetryAfter = time.Until(resetAt)
+	}
+	return d
+}
+
+// check counts the request against every limit if all of them admit it. It
+// returns the 1-based index of the limit that rejected it, or 0, along with
+// the index of the limit the decision is about and the units left under it.
+// Without scripts all of the user's counters are kept in a single value.
+func (c *Controller) check(userID string, now time.Time, cost int) (int64, int64, int64, error) {
+	sr, ok := c.Store.(cache.ScriptRunner)
+	if !ok {
+		return c.checkCAS(userID, now, cost)
+	}
+
+	keys := make([]string, 0, 2*len(c.Limits))
+	args := make([]any, 0, 1+3*len(c.Limits))
+	args = append(args, cost)
+
+	for _, l := range c.Limits {
+		windowID, elapsed := window(l, now)
+		keys = append(keys, windowKey(userID, l.Period, windowID), windowKey(userID, l.Period, windowID-1))
+		args = append(args, l.Capacity, elapsed, 2*l.Period)
+	}
+
+	res, err := sr.RunScript(context.Background(), multiWindowScript, keys, args...)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	vals, ok := res.([]any)
+	if !ok || len(vals) != 3 {
+		return 0, 0, 0, errors.New("unexpected script result")
+	}
+	rejectedBy, ok1 := vals[0].(int64)
+	index, ok2 := vals[1].(int64)
+	remaining, ok3 := vals[2].(int64)
+	if !ok1 || !ok2 || !ok3 || index < 1 || int(index) > len(c.Limits) {
+		return 0, 0, 0, errors.New("unexpected script result")
+	}
+	return rejectedBy, index, remaining, nil
+}
+
+func (c *Controller) checkCAS(userID string, now time.Time, cost int) (int64, int64, int64, error) {
+	var ttl time.Duration
+	for _, l := range c.Limits {
+		ttl = max(ttl, 2*time.Duration(l.Period)*time.Second)
+	}
+
+	var rejectedBy, index, remaining int64
+	var counters map[string]int64
+	err := cache.UpdateJSON(context.Background(), c.Store, "multiwindow:{"+userID+"}", ttl, &counters,
+		func(counters *map[string]int64) (bool, error) {
+			// Only the windows in use are carried over.
+			live := make(map[string]int64, 2*len(c.Limits))
+			var least float64
+			index = 0
+			for i, l := range c.Limits {
+				windowID, elapsed := window(l, now)
+				cur := fmt.Sprintf("%d:%d", l.Period, windowID)
+				prev := fmt.Sprintf("%d:%d", l.Period, windowID-1)
+				live[cur], live[prev] = (*counters)[cur], (*counters)[prev]
+
+				left := float64(l.Capacity) - (float64(live[prev])*(1-elapsed) + float64(live[cur]))
+				if left < float64(cost) {
+					rejectedBy, index, remaining = int64(i+1), int64(i+1), max(0, int64(math.Floor(left)))
+					return false, nil
+				}
+				if index == 0 || left < least {
+					index, least = int64(i+1), left
+				}
+			}
+
+			for _, l := range c.Limits {
+				windowID, _ := window(l, now)
+				live[fmt.Sprintf("%d:%d", l.Period, windowID)] += int64(cost)
+			}
+			*counters = live
+			rejectedBy, remaining = 0, int64(math.Floor(least-float64(cost)))
+			return true, nil
+		})
+	return rejectedBy, index, remaining, err
+}
+
+// Refund takes cost units off the current window of every limit.
+func (c *Controller) Refund(userID string, cost int) error {
+	now := time.Now()
+
+	if _, ok := c.Store.(cache.ScriptRunner); ok {
+		keys := make([]string, len(c.Limits))
+		for i, l := range c.Limits {
+			windowID, _ := window(l, now)
+			keys[i] = windowKey(userID, l.Period, windowID)
+		}
+		return cache.Decrement(context.Background(), c.Store, int64(cost), keys...)
+	}
+
+	var counters map[string]int64
+	return cache.UpdateJSON(context.Background(), c.Store, "multiwindow:{"+userID+"}", 0, &counters,
+		func(counters *map[string]int64) (bool, error) {
+			var changed bool
+			for _, l := range c.Limits {
+				windowID, _ := window(l, now)
+				cur := fmt.Sprintf("%d:%d", l.Period, windowID)
+				if n := (*counters)[cur]; n > 0 {
+					(*counters)[cur] = max(0, n-int64(cost))
+					changed = true
+				}
+			}
+			return changed, nil
+		})
+}
+
+// window returns the ID of the limit's current window and the fraction of it
+// that has elapsed.
+func window(l Limit, now time.Time) (int64, float64) {
+	size := time.Duration(l.Period) * time.Second
+	return now.UnixNano() / int64(size), float64(now.UnixNano()%int64(size)) / float64(size)
+}
+
+// windowKey returns the key of a window counter.
+func windowKey(userID string, period int, windowID int64) string {
+	return fmt.Sprintf("multiwindow:{%s}:%d:%d", userID, period, windowID)
+}
@@ -0,0 +1,76 @@
+package ratelimiter_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	ratelimiter "github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter"
+)
+
+func TestHierarchyCheck(t *testing.T) {
+	h, err := ratelimiter.NewHierarchy(ratelimiter.HierarchyConfig{
+		Levels: []ratelimiter.LevelConfig{
+			{
+				Scope: "user",
+				Tier:  ratelimiter.Tier{Algo: ratelimiter.FixedWindow, Period: 60, Capacity: 2},
+				Owner: ratelimiter.ResolverConfig{Users: map[string]string{"key-1": "alice", "key-2": "bob"}},
+			},
+			{
+				Scope: "org",
+				Tier:  ratelimiter.Tier{Algo: ratelimiter.FixedWindow, Period: 60, Capacity: 3},
+				Owner: ratelimiter.ResolverConfig{Users: map[string]string{"alice": "acme", "bob": "acme"}},
+			},
+		},
+		KvStore: newRedis(t),
+		Log:     newLogger(),
+	})
+	if err != nil {
+		t.Fatalf("constructing hierarchy: %s", err)
+	}
+
+	// alice uses up the user limit, then bob uses up what is left of the limit
+	// of the organization they share. Keys without an owner skip the levels.
+	steps := []struct {
+		key   string
+		want  bool
+		scope string
+	}{
+		{key: "key-1", want: true},
+		{key: "key-1", want: true},
+		{key: "key-1", want: false, scope: "user"},
+		{key: "key-2", want: true},
+		{key: "key-2", want: false, scope: "org"},
+		{key: "key-3", want: true},
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	for i, s := range steps {
+		d, _ := h.Check(context.Background(), r, s.key, 1)
+		if d.Err != nil {
+			t.Fatalf("request %d: %s", i+1, d.Err)
+		}
+		if d.Allowed != s.want {
+			t.Fatalf("request %d for %s: got %+v, want allowed %t", i+1, s.key, d, s.want)
+		}
+		if !d.Allowed && !strings.HasPrefix(d.Policy, s.scope) {
+			t.Errorf("request %d for %s: got policy %q, want the %s level's", i+1, s.key, d.Policy, s.scope)
+		}
+	}
+}
+
+func TestHierarchyObserver(t *testing.T) {
+	_, err := ratelimiter.NewHierarchy(ratelimiter.HierarchyConfig{
+		Levels: []ratelimiter.LevelConfig{{
+			Scope: "org",
+			Tier:  ratelimiter.Tier{Algo: ratelimiter.Adaptive, Capacity: 10},
+			Owner: ratelimiter.ResolverConfig{Users: map[string]string{"alice": "acme"}},
+		}},
+		KvStore: newRedis(t),
+		Log:     newLogger(),
+	})
+	if err == nil {
+		t.Errorf("got a hierarchy with an adaptive level, want an error")
+	}
+}
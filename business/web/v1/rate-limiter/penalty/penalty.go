@@ -0,0 +1,258 @@
+package penalty
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Zanda256/rate-limiter-go/business/data/cache"
+	"github.com/Zanda256/rate-limiter-go/foundation/logger"
+)
+
+// Defaults used for the settings that aren't configured.
+const (
+	DefaultThreshold    = 10
+	DefaultSpan         = 60
+	DefaultForgiveAfter = 24 * 60 * 60
+)
+
+// DefaultCooldowns are the bans handed out for a first, second and third or
+// later offence, in seconds.
+var DefaultCooldowns = []int{60, 5 * 60, 60 * 60}
+
+// denialScript counts a denial and bans the key once it has been denied
+// threshold times within the span.
+//
+//	KEYS[1]   denials within the current span
+//	KEYS[2]   offences that haven't been forgiven yet
+//	KEYS[3]   ban, holding its end as unix time in milliseconds
+//	ARGV[1]   now, unix time in milliseconds
+//	ARGV[2]   threshold
+//	ARGV[3]   span, in seconds
+//	ARGV[4]   time after which offences are forgiven, in seconds
+//	ARGV[4+i] cooldown of the i-th offence, in milliseconds
+//
+// It returns {offence, end of the ban} when the denial bans the key, or
+// {0, 0} when it doesn't.
+var denialScript = cache.NewScript(`
+local denials = redis.call("INCR", KEYS[1])
+if denials == 1 then
+	redis.call("EXPIRE", KEYS[1], ARGV[3])
+end
+if denials < tonumber(ARGV[2]) then
+	return {0, 0}
+end
+redis.call("DEL", KEYS[1])
+
+local offence = redis.call("INCR", KEYS[2])
+redis.call("EXPIRE", KEYS[2], ARGV[4])
+
+local cooldown = tonumber(ARGV[4 + math.min(offence, #ARGV - 4)])
+local ends = tonumber(ARGV[1]) + cooldown
+redis.call("SET", KEYS[3], string.format("%.0f", ends), "PX", cooldown)
+return {offence, ends}
+`)
+
+// Jail bans keys that keep getting denied, fail2ban style. A key denied
+// Threshold times within Span is banned, first for the first cooldown, then
+// for the next one on every further offence. Offences are forgiven once the
+// key has behaved for ForgiveAfter.
+type Jail struct {
+	Log          *logger.Logger
+	Store        cache.Store
+	Threshold    int
+	Span         time.Duration
+	Cooldowns    []time.Duration
+	ForgiveAfter time.Duration
+}
+
+// Config declares when keys are banned and for how long. Durations are in
+// seconds.
+type Config struct {
+	Threshold    int   `json:"threshold,omitempty"`
+	Span         int   `json:"span,omitempty"`
+	Cooldowns    []int `json:"cooldowns,omitempty"`
+	ForgiveAfter int   `json:"forgiveAfter,omitempty"`
+}
+
+type JailConfig struct {
+	Log    *logger.Logger
+	Store  cache.Store
+	Config Config
+}
+
+// NewJail validates the configuration and constructs a jail. Settings that
+// aren't configured get their defaults.
+func NewJail(cfg JailConfig) (*Jail, error) {
+	c := cfg.Config
+	if c.Threshold == 0 {
+		c.Threshold = DefaultThreshold
+	}
+	if c.Span == 0 {
+		c.Span = DefaultSpan
+	}
+	if c.ForgiveAfter == 0 {
+		c.ForgiveAfter = DefaultForgiveAfter
+	}
+	if len(c.Cooldowns) == 0 {
+		c.Cooldowns = DefaultCooldowns
+	}
+	if c.Threshold < 1 || c.Span < 1 || c.ForgiveAfter < 1 {
+		return nil, errors.New("threshold, span and forgiveAfter must be positive")
+	}
+
+	cooldowns := make([]time.Duration, len(c.Cooldowns))
+	for i, secs := range c.Cooldowns {
+		if secs < 1 {
+			return nil, fmt.Errorf("cooldown %d must be positive", i)
+		}
+		cooldowns[i] = time.Duration(secs) * time.Second
+	}
+
+	return &Jail{
+		Log:          cfg.Log,
+		Store:        cfg.Store,
+		Threshold:    c.Threshold,
+		Span:         time.Duration(c.Span) * time.Second,
+		Cooldowns:    cooldowns,
+		ForgiveAfter: time.Duration(c.ForgiveAfter) * time.Second,
+	}, nil
+}
+
+// BannedUntil returns the end of the key's ban, or the zero time when the key
+// isn't banned.
+func (j *Jail) BannedUntil(ctx context.Context, key string) (time.Time, error) {
+	v, err := j.Store.RetrieveValue(ctx, banKey(key))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("retrieving ban of %q: %w", key, err)
+	}
+	if v == nil {
+		return time.Time{}, nil
+	}
+
+	s, ok := v.(string)
+	if !ok {
+		return time.Time{}, errors.New("cannot marshal retrieved value into string")
+	}
+	ms, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parsing ban of %q: %w", key, err)
+	}
+	if until := time.UnixMilli(ms); until.After(time.Now()) {
+		return until, nil
+	}
+	return time.Time{}, nil
+}
+
+// RecordDenial counts a denial against the key. When it takes the key over
+// the threshold the key is banned, and the end of the ban is returned;
+// otherwise the zero time is.
+func (j *Jail) RecordDenial(ctx context.Context, key string) (time.Time, error) {
+	offence, ends, err := j.record(ctx, key, time.Now())
+	if err != nil {
+		return time.Time{}, err
+	}
+	if offence == 0 {
+		return time.Time{}, nil
+	}
+
+	until := time.UnixMilli(ends)
+	j.Log.Warn(ctx, "key banned", "key", key, "offence", offence, "until", until.Format(time.RFC3339))
+	return until, nil
+}
+
+// record runs denialScript when the store can run scripts, and the same steps
+// one at a time otherwise. It returns the offence and the end of the ban in
+// unix milliseconds when the denial bans the key, or zeros when it doesn't.
+func (j *Jail) record(ctx context.Context, key string, now time.Time) (int64, int64, error) {
+	sr, ok := j.Store.(cache.ScriptRunner)
+	if !ok {
+		return j.recordSteps(ctx, key, now)
+	}
+
+	args := make([]any, 0, 4+len(j.Cooldowns))
+	args = append(args, now.UnixMilli(), j.Threshold, int(j.Span/time.Second), int(j.ForgiveAfter/time.Second))
+	for _, c := range j.Cooldowns {
+		args = append(args, c.Milliseconds())
+	}
+
+	keys := []string{denialsKey(key), offencesKey(key), banKey(key)}
+	res, err := sr.RunScript(ctx, denialScript, keys, args...)
+	if err != nil {
+		return 0, 0, fmt.Errorf("denial script: %w", err)
+	}
+
+	vals, ok := res.([]any)
+	if !ok || len(vals) != 2 {
+		return 0, 0, errors.New("denial script: unexpected script result")
+	}
+	offence, ok1 := vals[0].(int64)
+	ends, ok2 := vals[1].(int64)
+	if !ok1 || !ok2 {
+		return 0, 0, errors.New("denial script: unexpected script result")
+	}
+	return offence, ends, nil
+}
+
+// recordSteps is record for stores that can't run scripts. Concurrent
+// denials may both ban the key, which only extends the ban.
+func (j *Jail) recordSteps(ctx context.Context, key string, now time.Time) (int64, int64, error) {
+	denials, err := j.Store.Increment(ctx, denialsKey(key), 1)
+	if err != nil {
+		return 0, 0, err
+	}
+	if denials == 1 {
+		if err := j.Store.Expire(ctx, denialsKey(key), j.Span); err != nil {
+			return 0, 0, err
+		}
+	}
+	if denials < int64(j.Threshold) {
+		return 0, 0, nil
+	}
+	if err := j.Store.DeleteValues(ctx, denialsKey(key)); err != nil {
+		return 0, 0, err
+	}
+
+	offence, err := j.Store.Increment(ctx, offencesKey(key), 1)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := j.Store.Expire(ctx, offencesKey(key), j.ForgiveAfter); err != nil {
+		return 0, 0, err
+	}
+
+	cooldown := j.Cooldowns[min(int(offence), len(j.Cooldowns))-1]
+	ends := now.Add(cooldown).UnixMilli()
+	if _, err := j.Store.StoreValue(ctx, banKey(key), strconv.FormatInt(ends, 10), int(cooldown/time.Minute)+1); err != nil {
+		return 0, 0, err
+	}
+	if err := j.Store.Expire(ctx, banKey(key), cooldown); err != nil {
+		return 0, 0, err
+	}
+	return offence, ends, nil
+}
+
+// Clear lifts the key's ban and forgives its offences.
+func (j *Jail) Clear(ctx context.Context, key string) error {
+	if err := j.Store.DeleteValues(ctx, denialsKey(key), offencesKey(key), banKey(key)); err != nil {
+		return fmt.Errorf("clearing ban of %q: %w", key, err)
+	}
+	j.Log.Info(ctx, "ban cleared", "key", key)
+	return nil
+}
+
+// denialsKey, offencesKey and banKey return the keys holding the state of a
+// jailed key.
+func denialsKey(key string) string {
+	return fmt.Sprintf("penalty:{%s}:denials", key)
+}
+
+func offencesKey(key string) string {
+	return fmt.Sprintf("penalty:{%s}:offences", key)
+}
+
+func banKey(key string) string {
+	return fmt.Sprintf("penalty:{%s}:ban", key)
+}
@@ -0,0 +1,265 @@
+package priority
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Zanda256/rate-limiter-go/business/data/cache"
+	"github.com/Zanda256/rate-limiter-go/foundation/logger"
+)
+
+// Class is a priority class. Reserved units of the shared budget are
+// guaranteed to the class every period, whatever the other classes do. Beyond
+// that the class may borrow whatever the other classes haven't used or
+// reserved, up to Max units.
+type Class struct {
+	Name     string `json:"name"`
+	Reserved int    `json:"reserved"`
+	Max      int    `json:"max,omitempty"`
+}
+
+// shedScript admits a request of one class against the shared budget.
+//
+//	KEYS[i]      usage of class i in the current window
+//	ARGV[1]      budget shared by all classes
+//	ARGV[2]      index of the class of the request
+//	ARGV[3]      cost of the request
+//	ARGV[4]      ttl of the usage counters, in seconds
+//	ARGV[3+2i]   units reserved for class i
+//	ARGV[4+2i]   most units class i may use
+//
+// It returns 1 when the request is admitted and 0 when it is shed.
+var shedScript = cache.NewScript(`
+local budget = tonumber(ARGV[1])
+local class = tonumber(ARGV[2])
+local cost = tonumber(ARGV[3])
+
+local total = 0
+local used = 0
+local reservedByOthers = 0
+for i = 1, #KEYS do
+	local u = tonumber(redis.call("GET", KEYS[i]) or "0")
+	total = total + u
+	if i == class then
+		used = u
+	else
+		local reserved = tonumber(ARGV[3+2*i])
+		if reserved > u then
+			reservedByOthers = reservedByOthers + reserved - u
+		end
+	end
+end
+
+if used + cost > tonumber(ARGV[4+2*class]) then
+	return 0
+end
+if used + cost > tonumber(ARGV[3+2*class]) and total + cost > budget - reservedByOthers then
+	return 0
+end
+
+redis.call("INCRBY", KEYS[class], cost)
+redis.call("EXPIRE", KEYS[class], ARGV[4])
+return 1
+`)
+
+// Shedder shares a service wide budget of Budget units every Period seconds
+// between priority classes. When the budget runs low, the classes without
+// reservations are shed first.
+type Shedder struct {
+	Log          *logger.Logger
+	Store        cache.Store
+	Period       int
+	Budget       int
+	Header       string
+	DefaultClass string
+	classes      []Class
+	index        map[string]int
+}
+
+// Config declares the budget and its classes. Header names the request
+// header carrying the class; it should only be trusted when set by a gateway.
+type Config struct {
+	Period       int     `json:"period"`
+	Budget       int     `json:"budget"`
+	Header       string  `json:"header,omitempty"`
+	DefaultClass string  `json:"default"`
+	Classes      []Class `json:"classes"`
+}
+
+type ShedderConfig struct {
+	Log    *logger.Logger
+	Store  cache.Store
+	Config Config
+}
+
+// NewShedder validates the classes and constructs a shedder. The reservations
+// of all classes together must fit in the budget.
+func NewShedder(cfg ShedderConfig) (*Shedder, error) {
+	c := cfg.Config
+	if c.Period < 1 || c.Budget < 1 {
+		return nil, errors.New("period and budget must be positive")
+	}
+	if len(c.Classes) == 0 {
+		return nil, errors.New("at least one priority class is required")
+	}
+
+	classes := make([]Class, len(c.Classes))
+	index := make(map[string]int, len(c.Classes))
+	var reserved int
+	for i, cl := range c.Classes {
+		if cl.Max == 0 {
+			cl.Max = c.Budget
+		}
+		if cl.Reserved < 0 || cl.Reserved > cl.Max {
+			return nil, fmt.Errorf("class %q: reserved must be between 0 and max", cl.Name)
+		}
+		if _, dup := index[cl.Name]; dup {
+			return nil, fmt.Errorf("class %q declared twice", cl.Name)
+		}
+		reserved += cl.Reserved
+		classes[i] = cl
+		index[cl.Name] = i
+	}
+	if reserved > c.Budget {
+		return nil, fmt.Errorf("classes reserve %d units, more than the budget of %d", reserved, c.Budget)
+	}
+	if _, ok := index[c.DefaultClass]; !ok {
+		return nil, fmt.Errorf("default class %q is not declared", c.DefaultClass)
+	}
+
+	return &Shedder{
+		Log:          cfg.Log,
+		Store:        cfg.Store,
+		Period:       c.Period,
+		Budget:       c.Budget,
+		Header:       c.Header,
+		DefaultClass: c.DefaultClass,
+		classes:      classes,
+		index:        index,
+	}, nil
+}
+
+// Accept reports whether a request of the named class, costing cost units,
+// fits in the shared budget. Unknown classes are treated as the default class.
+// It fails when the budget can't be checked.
+func (s *Shedder) Accept(class string, cost int) (bool, error) {
+	class, i := s.class(class)
+
+	admitted, err := s.admit(i, cost)
+	if err != nil {
+		return false, fmt.Errorf("shed: %w", err)
+	}
+
+	if !admitted {
+		s.Log.Warn(context.Background(), "shedding request", "class", class, "cost", cost)
+		return false, nil
+	}
+	return true, nil
+}
+
+// Refund gives back cost units a request of the named class took from the
+// current period's budget, so that a request turned away after it was
+// accepted doesn't keep them.
+func (s *Shedder) Refund(class string, cost int) error {
+	class, i := s.class(class)
+	windowID := time.Now().Unix() / int64(s.Period)
+
+	if _, ok := s.Store.(cache.ScriptRunner); ok {
+		return cache.Decrement(context.Background(), s.Store, int64(cost), usageKey(windowID, class))
+	}
+
+	var usage map[string]int
+	return cache.UpdateJSON(context.Background(), s.Store, usageKey(windowID, ""), 0, &usage, func(usage *map[string]int) (bool, error) {
+		name := s.classes[i].Name
+		if (*usage)[name] == 0 {
+			return false, nil
+		}
+		(*usage)[name] = max(0, (*usage)[name]-cost)
+		return true, nil
+	})
+}
+
+// class returns the name and index of the named class, or of the default
+// class when it isn't declared.
+func (s *Shedder) class(class string) (string, int) {
+	i, ok := s.index[class]
+	if !ok {
+		class = s.DefaultClass
+		i = s.index[class]
+	}
+	return class, i
+}
+
+// usageKey returns the key of the usage counter of a class in a window, or
+// of the usage of every class when class is empty.
+func usageKey(windowID int64, class string) string {
+	if class == "" {
+		return fmt.Sprintf("priority:{shed}:%d", windowID)
+	}
+	return fmt.Sprintf("priority:{shed}:%d:%s", windowID, class)
+}
+
+// admit checks a request of the i-th class against the budget. Without
+// scripts the usage of every class is kept in a single value.
+func (s *Shedder) admit(i int, cost int) (bool, error) {
+	windowID := time.Now().Unix() / int64(s.Period)
+
+	sr, ok := s.Store.(cache.ScriptRunner)
+	if !ok {
+		return s.admitCAS(windowID, i, cost)
+	}
+
+	keys := make([]string, len(s.classes))
+	args := make([]any, 0, 4+2*len(s.classes))
+	args = append(args, s.Budget, i+1, cost, 2*s.Period)
+	for j, cl := range s.classes {
+		keys[j] = usageKey(windowID, cl.Name)
+		args = append(args, cl.Reserved, cl.Max)
+	}
+
+	res, err := sr.RunScript(context.Background(), shedScript, keys, args...)
+	if err != nil {
+		return false, err
+	}
+	admitted, ok := res.(int64)
+	if !ok {
+		return false, errors.New("unexpected script result")
+	}
+	return admitted == 1, nil
+}
+
+func (s *Shedder) admitCAS(windowID int64, i int, cost int) (bool, error) {
+	key := usageKey(windowID, "")
+	ttl := 2 * time.Duration(s.Period) * time.Second
+
+	var admitted bool
+	var usage map[string]int
+	err := cache.UpdateJSON(context.Background(), s.Store, key, ttl, &usage, func(usage *map[string]int) (bool, error) {
+		if *usage == nil {
+			*usage = make(map[string]int, len(s.classes))
+		}
+
+		var total, reservedByOthers int
+		for j, cl := range s.classes {
+			u := (*usage)[cl.Name]
+			total += u
+			if j != i && cl.Reserved > u {
+				reservedByOthers += cl.Reserved - u
+			}
+		}
+
+		cl := s.classes[i]
+		used := (*usage)[cl.Name]
+		admitted = used+cost <= cl.Max &&
+			(used+cost <= cl.Reserved || total+cost <= s.Budget-reservedByOthers)
+		if !admitted {
+			return false, nil
+		}
+
+		(*usage)[cl.Name] = used + cost
+		return true, nil
+	})
+	return admitted, err
+}
@@ -0,0 +1,115 @@
+package priority_test
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/Zanda256/rate-limiter-go/business/data/cache"
+	"github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter/priority"
+	"github.com/Zanda256/rate-limiter-go/foundation/logger"
+	"github.com/alicebob/miniredis/v2"
+)
+
+func newShedder(t *testing.T, cfg priority.Config) (*priority.Shedder, error) {
+	t.Helper()
+	store, err := cache.NewRedisCache(cache.RedisConfig{Addrs: []string{miniredis.RunT(t).Addr()}})
+	if err != nil {
+		t.Fatalf("connecting to redis: %s", err)
+	}
+	return priority.NewShedder(priority.ShedderConfig{
+		Log:    logger.New(io.Discard, logger.LevelError, "TEST", func(context.Context) string { return "" }),
+		Store:  store,
+		Config: cfg,
+	})
+}
+
+func TestShedderReservations(t *testing.T) {
+	s, err := newShedder(t, priority.Config{
+		Period:       60,
+		Budget:       10,
+		DefaultClass: "batch",
+		Classes: []priority.Class{
+			{Name: "critical", Reserved: 4},
+			{Name: "batch"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("constructing shedder: %s", err)
+	}
+
+	// Batch requests, and requests of unknown classes treated as batch, can
+	// only borrow what critical doesn't reserve.
+	steps := []struct {
+		class string
+		cost  int
+		want  bool
+	}{
+		{class: "batch", cost: 5, want: true},
+		{class: "unknown", cost: 1, want: true},
+		{class: "batch", cost: 1, want: false},
+		{class: "critical", cost: 4, want: true},
+		{class: "critical", cost: 1, want: false},
+	}
+	for i, st := range steps {
+		got, err := s.Accept(st.class, st.cost)
+		if err != nil {
+			t.Fatalf("request %d of class %s: %s", i+1, st.class, err)
+		}
+		if got != st.want {
+			t.Fatalf("request %d of class %s: got %t, want %t", i+1, st.class, got, st.want)
+		}
+	}
+}
+
+func TestShedderConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  priority.Config
+	}{
+		{
+			name: "reservations over budget",
+			cfg: priority.Config{Period: 60, Budget: 5, DefaultClass: "a", Classes: []priority.Class{
+				{Name: "a", Reserved: 3}, {Name: "b", Reserved: 3},
+			}},
+		},
+		{
+			name: "undeclared default",
+			cfg:  priority.Config{Period: 60, Budget: 5, DefaultClass: "c", Classes: []priority.Class{{Name: "a"}}},
+		},
+		{
+			name: "duplicate class",
+			cfg:  priority.Config{Period: 60, Budget: 5, DefaultClass: "a", Classes: []priority.Class{{Name: "a"}, {Name: "a"}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newShedder(t, tt.cfg); err == nil {
+				t.Errorf("got no error")
+			}
+		})
+	}
+}
+
+func TestShedderStoreError(t *testing.T) {
+	mr := miniredis.RunT(t)
+	store, err := cache.NewRedisCache(cache.RedisConfig{Addrs: []string{mr.Addr()}})
+	if err != nil {
+		t.Fatalf("connecting to redis: %s", err)
+	}
+	mr.Close()
+
+	s, err := priority.NewShedder(priority.ShedderConfig{
+		Log:    logger.New(io.Discard, logger.LevelError, "TEST", func(context.Context) string { return "" }),
+		Store:  store,
+		Config: priority.Config{Period: 60, Budget: 10, DefaultClass: "batch", Classes: []priority.Class{{Name: "batch"}}},
+	})
+	if err != nil {
+		t.Fatalf("constructing shedder: %s", err)
+	}
+
+	// A budget that can't be checked is an error, not a shed request.
+	if _, err := s.Accept("batch", 1); err == nil {
+		t.Errorf("got no error with the store down")
+	}
+}
@@ -0,0 +1,185 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Zanda256/rate-limiter-go/business/data/cache"
+	"github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter/decision"
+	"github.com/Zanda256/rate-limiter-go/foundation/logger"
+)
+
+// Calendar periods a quota can reset on.
+const (
+	Day   = "day"
+	Week  = "week"
+	Month = "month"
+)
+
+// quotaScript consumes from a quota counter that expires at the end of the
+// calendar period it belongs to.
+//
+//	KEYS[1] counter of the current calendar period
+//	ARGV[1] cost of the request
+//	ARGV[2] quota
+//	ARGV[3] end of the calendar period, unix time in milliseconds
+//
+// It returns {1, usage after the request} when the request fits, or
+// {0, current usage} when it doesn't.
+var quotaScript = cache.NewScript(`
+local cost = tonumber(ARGV[1])
+local used = tonumber(redis.call("GET", KEYS[1]) or "0")
+if used + cost > tonumber(ARGV[2]) then
+	return {0, used}
+end
+
+used = redis.call("INCRBY", KEYS[1], cost)
+redis.call("PEXPIREAT", KEYS[1], ARGV[3])
+return {1, used}
+`)
+
+// Controller enforces a quota of Quota units per calendar day, week or month
+// in the configured time zone. Weeks start on Monday. Usage is reset on the
+// calendar boundary, at which point the stored counter expires.
+type Controller struct {
+	Log      *logger.Logger
+	Store    cache.Store
+	Period   string
+	Quota    int
+	Location *time.Location
+}
+
+type ControllerConfig struct {
+	Log      *logger.Logger
+	Store    cache.Store
+	Period   string
+	Quota    int
+	TimeZone string
+}
+
+// NewController constructs a quota controller. It fails for unknown periods
+// and time zones that aren't in the IANA database. An empty time zone is UTC.
+func NewController(cfg ControllerConfig) (*Controller, error) {
+	switch cfg.Period {
+	case Day, Week, Month:
+	default:
+		return nil, fmt.Errorf("unknown quota period %q", cfg.Period)
+	}
+
+	loc, err := time.LoadLocation(cfg.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("loading time zone: %w", err)
+	}
+
+	return &Controller{
+		Log:      cfg.Log,
+		Store:    cfg.Store,
+		Period:   cfg.Period,
+		Quota:    cfg.Quota,
+		Location: loc,
+	}, nil
+}
+
+// Accept reports whether the user has cost units of quota left in the current
+// calendar period, consuming them if so. The decision resets at the end of the
+// period.
+func (c *Controller) Accept(userID string, cost int) decision.Decision {
+	start, end := c.bounds(time.Now())
+
+	allowed, used, err := c.consume(c.key(userID, start), cost, end)
+	if err != nil {
+		c.Log.Error(context.Background(), fmt.Sprintf("quota: %s", err.Error()))
+		return decision.Error(err)
+	}
+
+	d := decision.Decision{
+		Allowed:   allowed,
+		Limit:     c.Quota,
+		Remaining: max(0, c.Quota-int(used)),
+		ResetAt:   end,
+		Policy:    c.Period,
+	}
+	if !d.Allowed {
+		c.Log.Info(context.Background(), "quota exhausted", "userID", userID, "period", c.Period,
+			"resetsAt", end.Format(time.RFC3339))
+		d.RetryAfter = time.Until(end)
+	}
+	return d
+}
+
+// Refund gives cost units back to the quota of the current calendar period.
+func (c *Controller) Refund(userID string, cost int) error {
+	start, _ := c.bounds(time.Now())
+	return cache.Decrement(context.Background(), c.Store, int64(cost), c.key(userID, start))
+}
+
+// key returns the key of the user's counter for the calendar period starting
+// at start.
+func (c *Controller) key(userID string, start time.Time) string {
+	return fmt.Sprintf("quota:{%s}:%s:%s", userID, c.Period, start.Format("2006-01-02"))
+}
+
+// consume takes cost units from the counter stored at key if they fit in the
+// quota, and returns the usage afterwards.
+func (c *Controller) consume(key string, cost int, end time.Time) (bool, int64, error) {
+	if sr, ok := c.Store.(cache.ScriptRunner); ok {
+		res, err := sr.RunScript(context.Background(), quotaScript, []string{key}, cost, c.Quota, end.UnixMilli())
+		if err != nil {
+			return false, 0, err
+		}
+
+		vals, ok := res.([]any)
+		if !ok || len(vals) != 2 {
+			return false, 0, errors.New("unexpected script result")
+		}
+		allowed, ok1 := vals[0].(int64)
+		used, ok2 := vals[1].(int64)
+		if !ok1 || !ok2 {
+			return false, 0, errors.New("unexpected script result")
+		}
+		return allowed == 1, used, nil
+	}
+
+	var allowed bool
+	var used int64
+	err := cache.Update(context.Background(), c.Store, key, time.Until(end), func(cur string, found bool) (string, bool, error) {
+		used = 0
+		if found {
+			var err error
+			if used, err = strconv.ParseInt(cur, 10, 64); err != nil {
+				return "", false, err
+			}
+		}
+		if allowed = used+int64(cost) <= int64(c.Quota); !allowed {
+			return "", false, nil
+		}
+		used += int64(cost)
+		return strconv.FormatInt(used, 10), true, nil
+	})
+	return allowed, used, err
+}
+
+// bounds returns the start and end of the calendar period containing t.
+func (c *Controller) bounds(t time.Time) (time.Time, time.Time) {
+	t = t.In(c.Location)
+	y, m, d := t.Date()
+
+	switch c.Period {
+	case Week:
+		// time.Weekday counts from Sunday, shift it so Monday is 0.
+		offset := (int(t.Weekday()) + 6) % 7
+		start := time.Date(y, m, d-offset, 0, 0, 0, 0, c.Location)
+		return start, start.AddDate(0, 0, 7)
+
+	case Month:
+		start := time.Date(y, m, 1, 0, 0, 0, 0, c.Location)
+		return start, start.AddDate(0, 1, 0)
+
+	default:
+		start := time.Date(y, m, d, 0, 0, 0, 0, c.Location)
+		return start, start.AddDate(0, 0, 1)
+	}
+}
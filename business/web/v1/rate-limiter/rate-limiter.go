@@ -1,8 +1,19 @@
 package ratelimiter
 
 import (
+	"errors"
+	"fmt"
+
 	"github.com/Zanda256/rate-limiter-go/business/data/cache"
 	fixedwindowcounter "github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter/FixedWindowCounter"
+	leakybucket "github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter/LeakyBucket"
+	slidingwindow "github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter/SlidingWindow"
+	"github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter/adaptive"
+	"github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter/decision"
+	"github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter/gcra"
+	"github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter/multiwindow"
+	"github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter/quota"
+	"github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter/slidinglog"
 	"github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter/tokenbucket"
 	"github.com/Zanda256/rate-limiter-go/foundation/logger"
 )
@@ -11,33 +22,58 @@ import (
 var DefaultRateLimitPeriod = 30
 var DefaultRateLimitCapacity = 5
 
-// Write the supported types of rate limiting and their implementations in this file
-// Start with Leaky bucket
+// RateLimiterImpl enforces the limits of a single tier with the algorithm
+// named in Tier.Algo. Name identifies the tier, or the hierarchy level, in
+// the decisions it returns. OnFailure decides how requests whose limit
+// couldn't be checked are treated; Fallback is the local limiter used by
+// tiers that fail over to one.
 type RateLimiterImpl struct {
-	*tokenbucket.BucketController
-	*fixedwindowcounter.WindowController
+	Limiter
+	Algo      string
+	Name      string
+	OnFailure string
+	Fallback  Limiter
 }
 
-// type RateLimiter interface {
-// 	CheckUserLimit(string) bool
-// }
-
 type Algo int
 
+// Names of the built in algorithms. Tiers that don't name an algorithm use
+// MultiWindow when they declare Limits and FixedWindow otherwise.
 const (
-	// LeakyBucket   = "LeakyBucket"
-	TokenBucket = "TokenBucket"
-	FixedWindow = "FixedWindow"
-	// SlidingLog    = "SlidingLog"
-	// SlidingWindow = "SlidingWindow"
+	LeakyBucket   = "LeakyBucket"
+	TokenBucket   = "TokenBucket"
+	FixedWindow   = "FixedWindow"
+	SlidingWindow = "SlidingWindow"
+	SlidingLog    = "SlidingLog"
+	GCRA          = "GCRA"
+	Adaptive      = "Adaptive"
+	MultiWindow   = "MultiWindow"
+	Quota         = "Quota"
 )
 
+// Tier declares the limits of a group of callers and the algorithm that
+// enforces them. Limits are kept per caller, except for Adaptive tiers: their
+// limit follows the health of the backend, so every instance keeps a single
+// limit of its own, shared by all the callers of the tier.
 type Tier struct {
-	Algo     string `json:"algo"`
-	Period   int    `json:"period"`
-	Capacity int    `json:"capacity"`
+	Algo     string            `json:"algo"`
+	Period   int               `json:"period"`
+	Capacity int               `json:"capacity"`
+	Rate     int               `json:"rate,omitempty"`     // TokenBucket, GCRA and LeakyBucket: sustained units per period
+	Burst    int               `json:"burst,omitempty"`    // TokenBucket, GCRA and LeakyBucket: largest burst
+	Mode     string            `json:"mode,omitempty"`     // LeakyBucket only: "meter" (default) or "queue"
+	Adaptive adaptive.Settings `json:"adaptive,omitempty"` // Adaptive only, Capacity is the ceiling
+	Limits   []Limit           `json:"limits,omitempty"`   // MultiWindow only, all enforced together
+	Quota    string            `json:"quota,omitempty"`    // Quota only: "day", "week" or "month"
+	TimeZone string            `json:"timeZone,omitempty"` // Quota only: IANA name, UTC by default
+
+	OnFailure       string `json:"onFailure,omitempty"`       // "closed" (default), "open" or "local"
+	FallbackPercent int    `json:"fallbackPercent,omitempty"` // local only: share of the limits enforced, 50 by default
 }
 
+// Limit is one of several limits enforced together by a MultiWindow tier.
+type Limit = multiwindow.Limit
+
 // {
 // 	"basic":"{
 // 		"algo":"",
@@ -51,51 +87,268 @@ type Tier struct {
 // 	}"
 // }
 
+// PeriodOrDefault returns the tier's period in seconds, or
+// DefaultRateLimitPeriod when it isn't set.
+func (t Tier) PeriodOrDefault() int {
+	if t.Period == 0 {
+		return DefaultRateLimitPeriod
+	}
+	return t.Period
+}
+
+// CapacityOrDefault returns the tier's capacity, or DefaultRateLimitCapacity
+// when it isn't set.
+func (t Tier) CapacityOrDefault() int {
+	if t.Capacity == 0 {
+		return DefaultRateLimitCapacity
+	}
+	return t.Capacity
+}
+
+// RateOrDefault returns the sustained rate of the tier in units per period.
+// Tiers that don't set a rate sustain their capacity.
+func (t Tier) RateOrDefault() int {
+	if t.Rate == 0 {
+		return t.CapacityOrDefault()
+	}
+	return t.Rate
+}
+
+// BurstOrDefault returns the largest burst the tier tolerates. Tiers that
+// don't set a burst tolerate their capacity or, failing that, their rate.
+func (t Tier) BurstOrDefault() int {
+	switch {
+	case t.Burst != 0:
+		return t.Burst
+	case t.Capacity != 0:
+		return t.Capacity
+	default:
+		return t.RateOrDefault()
+	}
+}
+
 type RateLimiterConfig struct {
+	Name    string
 	Tier    Tier
-	KvStore *cache.RedisCache
+	KvStore cache.Store
 	Log     *logger.Logger
 }
 
-func NewRateLimiter(cfg RateLimiterConfig) *RateLimiterImpl {
-	t := tokenbucket.NewBucketController(tokenbucket.BucketControllerConfig{
-		Store: cfg.KvStore,
-		Period: func() int {
-			if cfg.Tier.Period == 0 {
-				return DefaultRateLimitPeriod
-			}
-			return cfg.Tier.Period
-		}(),
-		Capacity: func() int {
-			if cfg.Tier.Capacity == 0 {
-				return DefaultRateLimitPeriod
-			}
-			return cfg.Tier.Capacity
-		}(),
-		Log: cfg.Log,
-	})
-	fxW := fixedwindowcounter.NewWindowController(fixedwindowcounter.WindowControllerConfig{
-		Store: cfg.KvStore,
-		Log:   cfg.Log,
-		MaxTokens: func() int {
-			if cfg.Tier.Capacity == 0 {
-				return DefaultRateLimitPeriod
-			}
-			return cfg.Tier.Capacity
-		}(),
-		WindowSize: func() int64 {
-			if cfg.Tier.Period == 0 {
-				return int64(DefaultRateLimitPeriod)
-			}
-			return int64(cfg.Tier.Period)
-		}(),
-	})
+// NewRateLimiter builds the algorithm named in the tier. It fails if no
+// algorithm was registered under that name.
+func NewRateLimiter(cfg RateLimiterConfig) (*RateLimiterImpl, error) {
+	algo := cfg.Tier.Algo
+	switch {
+	case algo == "" && len(cfg.Tier.Limits) > 0:
+		algo = MultiWindow
+	case algo == "":
+		algo = FixedWindow
+	case algo != MultiWindow && len(cfg.Tier.Limits) > 0:
+		return nil, fmt.Errorf("limits are only supported by the %s algorithm, not %s", MultiWindow, algo)
+	}
+
+	factory, err := lookup(algo)
+	if err != nil {
+		return nil, err
+	}
+
+	lmt, err := factory(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("constructing %s limiter: %w", algo, err)
+	}
+
+	fallback, err := newFallback(factory, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("constructing %s fallback: %w", algo, err)
+	}
+
 	return &RateLimiterImpl{
-		BucketController: t,
-		WindowController: fxW,
+		Limiter:   lmt,
+		Algo:      algo,
+		Name:      cfg.Name,
+		OnFailure: cfg.Tier.OnFailure,
+		Fallback:  fallback,
+	}, nil
+}
+
+// CheckUserLimit checks whether the user may make a request costing cost
+// units. When the limit can't be checked the request is treated according to
+// the tier's failure mode. The policy of the decision is prefixed with the
+// limiter's name. Costs below a single unit are rejected with an error, as
+// the algorithms would give units back for them.
+func (rl *RateLimiterImpl) CheckUserLimit(userID string, cost int) Decision {
+	d, _ := rl.Admit(userID, cost)
+	return d
+}
+
+// Admit is CheckUserLimit for requests that may still be turned away by a
+// later check. The RefundFunc gives the units of an admitted request back to
+// the limiter that consumed them. It is nil when there is nothing to give
+// back, because the request wasn't admitted, the tier failed open or the
+// algorithm doesn't implement Refunder.
+func (rl *RateLimiterImpl) Admit(userID string, cost int) (Decision, RefundFunc) {
+	if err := checkCost(cost); err != nil {
+		return decision.Error(err), nil
+	}
+
+	d := rl.Limiter.Accept(userID, cost)
+	if d.Err != nil {
+		d, refund := rl.failover(userID, cost, d)
+		return rl.named(d), refund
+	}
+	return rl.named(d), refundFor(rl.Limiter, userID, cost, d)
+}
+
+// named prefixes the policy of the decision with the limiter's name.
+func (rl *RateLimiterImpl) named(d Decision) Decision {
+	switch {
+	case d.Policy == "":
+		d.Policy = rl.Name
+	case rl.Name != "":
+		d.Policy = rl.Name + ":" + d.Policy
+	}
+	return d
+}
+
+// refundFor returns the RefundFunc of a request lmt decided on, or nil when
+// there is nothing to give back.
+func refundFor(lmt Limiter, userID string, cost int, d Decision) RefundFunc {
+	r, ok := lmt.(Refunder)
+	if !ok || !d.Allowed {
+		return nil
+	}
+	return func() error {
+		return r.Refund(userID, cost)
+	}
+}
+
+// RefundFunc gives back the units a limiter consumed for a request.
+type RefundFunc func() error
+
+// Refunds collects the refunds of the checks a request passed, so that they
+// can all be given back when a later check turns it away.
+type Refunds []RefundFunc
+
+// Add records a refund. Nil refunds are ignored.
+func (rs *Refunds) Add(refund RefundFunc) {
+	if refund != nil {
+		*rs = append(*rs, refund)
+	}
+}
+
+// Refund gives back the units of every check, the latest first, and forgets
+// them so that they are only given back once. It carries on past refunds that
+// fail and returns their errors joined.
+func (rs *Refunds) Refund() error {
+	var errs []error
+	for i := len(*rs) - 1; i >= 0; i-- {
+		if err := (*rs)[i](); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	*rs = nil
+	return errors.Join(errs...)
+}
+
+// checkCost fails for costs that don't consume any units.
+func checkCost(cost int) error {
+	if cost < 1 {
+		return fmt.Errorf("cost %d must be at least 1", cost)
 	}
+	return nil
 }
 
-func (rl *RateLimiterImpl) CheckUserLimit(userID string) bool {
-	return rl.WindowController.Accept(userID)
+func init() {
+	Register(TokenBucket, func(cfg RateLimiterConfig) (Limiter, error) {
+		return tokenbucket.NewBucketController(tokenbucket.BucketControllerConfig{
+			Store:    cfg.KvStore,
+			Log:      cfg.Log,
+			Period:   cfg.Tier.PeriodOrDefault(),
+			Capacity: cfg.Tier.BurstOrDefault(),
+			Rate:     cfg.Tier.RateOrDefault(),
+		}), nil
+	})
+
+	Register(FixedWindow, func(cfg RateLimiterConfig) (Limiter, error) {
+		return fixedwindowcounter.NewWindowController(fixedwindowcounter.WindowControllerConfig{
+			Store:      cfg.KvStore,
+			Log:        cfg.Log,
+			MaxTokens:  cfg.Tier.CapacityOrDefault(),
+			WindowSize: int64(cfg.Tier.PeriodOrDefault()),
+		}), nil
+	})
+
+	Register(LeakyBucket, func(cfg RateLimiterConfig) (Limiter, error) {
+		switch cfg.Tier.Mode {
+		case "", leakybucket.ModeMeter, leakybucket.ModeQueue:
+		default:
+			return nil, fmt.Errorf("unknown leaky bucket mode %q", cfg.Tier.Mode)
+		}
+		return leakybucket.NewBucketController(leakybucket.BucketControllerConfig{
+			Store:    cfg.KvStore,
+			Log:      cfg.Log,
+			Period:   cfg.Tier.PeriodOrDefault(),
+			Capacity: cfg.Tier.BurstOrDefault(),
+			Rate:     cfg.Tier.RateOrDefault(),
+			Mode:     cfg.Tier.Mode,
+		}), nil
+	})
+
+	Register(SlidingWindow, func(cfg RateLimiterConfig) (Limiter, error) {
+		return slidingwindow.NewWindowController(slidingwindow.WindowControllerConfig{
+			Store:      cfg.KvStore,
+			Log:        cfg.Log,
+			MaxTokens:  cfg.Tier.CapacityOrDefault(),
+			WindowSize: int64(cfg.Tier.PeriodOrDefault()),
+		}), nil
+	})
+
+	Register(SlidingLog, func(cfg RateLimiterConfig) (Limiter, error) {
+		return slidinglog.NewLogController(slidinglog.LogControllerConfig{
+			Store:       cfg.KvStore,
+			Log:         cfg.Log,
+			MaxRequests: cfg.Tier.CapacityOrDefault(),
+			WindowSize:  int64(cfg.Tier.PeriodOrDefault()),
+		}), nil
+	})
+
+	Register(GCRA, func(cfg RateLimiterConfig) (Limiter, error) {
+		return gcra.NewController(gcra.ControllerConfig{
+			Store:    cfg.KvStore,
+			Log:      cfg.Log,
+			Period:   cfg.Tier.PeriodOrDefault(),
+			Capacity: cfg.Tier.RateOrDefault(),
+			Burst:    cfg.Tier.BurstOrDefault(),
+		}), nil
+	})
+
+	Register(MultiWindow, func(cfg RateLimiterConfig) (Limiter, error) {
+		limits := cfg.Tier.Limits
+		if len(limits) == 0 {
+			limits = []Limit{{Period: cfg.Tier.PeriodOrDefault(), Capacity: cfg.Tier.CapacityOrDefault()}}
+		}
+		return multiwindow.NewController(multiwindow.ControllerConfig{
+			Store:  cfg.KvStore,
+			Log:    cfg.Log,
+			Limits: limits,
+		})
+	})
+
+	Register(Quota, func(cfg RateLimiterConfig) (Limiter, error) {
+		return quota.NewController(quota.ControllerConfig{
+			Store:    cfg.KvStore,
+			Log:      cfg.Log,
+			Period:   cfg.Tier.Quota,
+			Quota:    cfg.Tier.CapacityOrDefault(),
+			TimeZone: cfg.Tier.TimeZone,
+		})
+	})
+
+	Register(Adaptive, func(cfg RateLimiterConfig) (Limiter, error) {
+		return adaptive.NewLimiter(adaptive.LimiterConfig{
+			Log:         cfg.Log,
+			MaxCapacity: cfg.Tier.CapacityOrDefault(),
+			Settings:    cfg.Tier.Adaptive,
+		}), nil
+	})
 }
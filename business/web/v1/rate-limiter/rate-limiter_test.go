@@ -0,0 +1,55 @@
+package ratelimiter
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/Zanda256/rate-limiter-go/business/data/cache"
+	"github.com/Zanda256/rate-limiter-go/foundation/logger"
+)
+
+func newLogger() *logger.Logger {
+	return logger.New(io.Discard, logger.LevelError, "TEST", func(context.Context) string { return "" })
+}
+
+func TestAdmitRefund(t *testing.T) {
+	log := newLogger()
+	store := cache.NewMemoryCache(cache.MemoryConfig{})
+	defer store.Close()
+
+	// Adaptive limiters hold a slot whatever the cost, the middleware tests
+	// cover them.
+	algos := []string{TokenBucket, FixedWindow, LeakyBucket, SlidingWindow, SlidingLog, GCRA, MultiWindow, Quota}
+	for _, algo := range algos {
+		t.Run(algo, func(t *testing.T) {
+			rl, err := NewRateLimiter(RateLimiterConfig{
+				Name:    algo,
+				Tier:    Tier{Algo: algo, Period: 60, Capacity: 3, Quota: "day"},
+				KvStore: store,
+				Log:     log,
+			})
+			if err != nil {
+				t.Fatalf("constructing limiter: %s", err)
+			}
+
+			d, refund := rl.Admit("alice", 3)
+			if !d.Allowed {
+				t.Fatalf("got %+v, want the request allowed", d)
+			}
+			if refund == nil {
+				t.Fatalf("got no refund for an allowed request")
+			}
+			if d := rl.CheckUserLimit("alice", 1); d.Allowed {
+				t.Fatalf("got %+v with the limit used up, want the request denied", d)
+			}
+
+			if err := refund(); err != nil {
+				t.Fatalf("refunding: %s", err)
+			}
+			if d := rl.CheckUserLimit("alice", 1); !d.Allowed {
+				t.Errorf("got %+v after the refund, want the request allowed", d)
+			}
+		})
+	}
+}
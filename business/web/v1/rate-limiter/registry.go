@@ -0,0 +1,83 @@
+package ratelimiter
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter/decision"
+)
+
+// Decision is the outcome of checking a request against a limit.
+type Decision = decision.Decision
+
+// Limiter is implemented by every rate limiting algorithm. Accept consumes
+// cost units from the user's limit when they are available and describes the
+// state of the limit either way.
+type Limiter interface {
+	Accept(userID string, cost int) Decision
+}
+
+// Observer is implemented by limiters that adapt to how the requests they
+// admitted fared. Observe is called once for every admitted request, after
+// the handler has returned.
+type Observer interface {
+	Observe(userID string, latency time.Duration, statusCode int)
+}
+
+// Refunder is implemented by limiters that can give back the units of a
+// request they admitted, so that a request turned away by a later check isn't
+// charged for it. Refund gives back cost units taken from the user's limit.
+type Refunder interface {
+	Refund(userID string, cost int) error
+}
+
+// Factory constructs the Limiter for a tier.
+type Factory func(cfg RateLimiterConfig) (Limiter, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Factory{}
+)
+
+// Register makes a rate limiting algorithm available under the provided name
+// so that tiers can select it through Tier.Algo. Packages outside this module
+// call it from an init function. It panics if the name is already taken or the
+// factory is nil.
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if factory == nil {
+		panic("ratelimiter: Register factory is nil")
+	}
+	if _, dup := registry[name]; dup {
+		panic("ratelimiter: Register called twice for algorithm " + name)
+	}
+	registry[name] = factory
+}
+
+// Algorithms returns the sorted names of the registered algorithms.
+func Algorithms() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookup(name string) (Factory, error) {
+	registryMu.RLock()
+	factory, ok := registry[name]
+	registryMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown rate limit algorithm %q, registered algorithms are %v", name, Algorithms())
+	}
+	return factory, nil
+}
@@ -0,0 +1,155 @@
+package ratelimiter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+
+	"github.com/Zanda256/rate-limiter-go/business/data/cache"
+)
+
+// Supported kinds of tier resolvers.
+const (
+	ResolverStatic = "static"
+	ResolverRedis  = "redis"
+	ResolverHeader = "header"
+)
+
+// TierResolver maps the identity of a caller to the name of the tier whose
+// limits apply to them.
+type TierResolver interface {
+	ResolveTier(ctx context.Context, r *http.Request, identity string) (string, error)
+}
+
+// StaticResolver resolves tiers from a fixed identity to tier map. Callers
+// that aren't in the map get the Default tier.
+type StaticResolver struct {
+	Tiers   map[string]string
+	Default string
+}
+
+// ResolveTier implements the TierResolver interface.
+func (sr StaticResolver) ResolveTier(ctx context.Context, r *http.Request, identity string) (string, error) {
+	if tier, ok := sr.Tiers[identity]; ok {
+		return tier, nil
+	}
+	return sr.Default, nil
+}
+
+// RedisHashResolver resolves tiers from a redis hash whose fields are caller
+// identities and whose values are tier names. Callers that aren't in the hash
+// get the Default tier.
+type RedisHashResolver struct {
+	Store   cache.HashStore
+	Hash    string
+	Default string
+}
+
+// ResolveTier implements the TierResolver interface.
+func (rr RedisHashResolver) ResolveTier(ctx context.Context, r *http.Request, identity string) (string, error) {
+	tier, err := rr.Store.RetrieveHashField(ctx, rr.Hash, identity)
+	if err != nil {
+		if errors.Is(err, cache.ErrKeyNotFound) {
+			return rr.Default, nil
+		}
+		return "", fmt.Errorf("resolving tier for %q: %w", identity, err)
+	}
+	return tier, nil
+}
+
+// HeaderResolver resolves tiers from a request header set by an API gateway
+// that has already authenticated the caller. Clients can set the header too,
+// so it is only trusted on requests coming from the Trusted networks of the
+// gateways; other requests, and requests without the header, get the Default
+// tier.
+type HeaderResolver struct {
+	Header  string
+	Default string
+	Trusted []netip.Prefix
+}
+
+// ResolveTier implements the TierResolver interface.
+func (hr HeaderResolver) ResolveTier(ctx context.Context, r *http.Request, identity string) (string, error) {
+	if !hr.trusts(r) {
+		return hr.Default, nil
+	}
+	if tier := r.Header.Get(hr.Header); tier != "" {
+		return tier, nil
+	}
+	return hr.Default, nil
+}
+
+// trusts reports whether the request comes straight from a trusted gateway.
+func (hr HeaderResolver) trusts(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range hr.Trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolverConfig selects and configures a TierResolver.
+type ResolverConfig struct {
+	Kind    string            `json:"kind"`
+	Default string            `json:"default,omitempty"`
+	Users   map[string]string `json:"users,omitempty"`   // static only
+	Store   cache.Store       `json:"-"`                 // redis only
+	Hash    string            `json:"hash,omitempty"`    // redis only
+	Header  string            `json:"header,omitempty"`  // header only
+	Trusted []string          `json:"trusted,omitempty"` // header only: addresses or CIDRs of the gateways
+}
+
+// NewTierResolver constructs the resolver named by cfg.Kind. An empty kind
+// gives a static resolver.
+func NewTierResolver(cfg ResolverConfig) (TierResolver, error) {
+	switch cfg.Kind {
+	case "", ResolverStatic:
+		return StaticResolver{Tiers: cfg.Users, Default: cfg.Default}, nil
+
+	case ResolverRedis:
+		if cfg.Hash == "" {
+			return nil, errors.New("redis tier resolver requires a hash key")
+		}
+		hs, ok := cfg.Store.(cache.HashStore)
+		if !ok {
+			return nil, errors.New("redis tier resolver requires a store with hashes")
+		}
+		return RedisHashResolver{Store: hs, Hash: cfg.Hash, Default: cfg.Default}, nil
+
+	case ResolverHeader:
+		if cfg.Header == "" {
+			return nil, errors.New("header tier resolver requires a header name")
+		}
+		if len(cfg.Trusted) == 0 {
+			return nil, errors.New("header tier resolver requires the addresses of the trusted gateways")
+		}
+		trusted := make([]netip.Prefix, len(cfg.Trusted))
+		for i, t := range cfg.Trusted {
+			p, err := netip.ParsePrefix(t)
+			if err != nil {
+				addr, aerr := netip.ParseAddr(t)
+				if aerr != nil {
+					return nil, fmt.Errorf("header tier resolver: trusted gateway %q: %w", t, err)
+				}
+				p = netip.PrefixFrom(addr, addr.BitLen())
+			}
+			trusted[i] = p.Masked()
+		}
+		return HeaderResolver{Header: cfg.Header, Default: cfg.Default, Trusted: trusted}, nil
+	}
+
+	return nil, fmt.Errorf("unknown tier resolver %q", cfg.Kind)
+}
@@ -0,0 +1,76 @@
+package ratelimiter_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	ratelimiter "github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter"
+)
+
+func TestHeaderResolver(t *testing.T) {
+	tr, err := ratelimiter.NewTierResolver(ratelimiter.ResolverConfig{
+		Kind:    ratelimiter.ResolverHeader,
+		Default: "basic",
+		Header:  "X-Tier",
+		Trusted: []string{"10.0.0.0/8", "192.0.2.7"},
+	})
+	if err != nil {
+		t.Fatalf("constructing resolver: %s", err)
+	}
+
+	// Only gateways may pick the tier; clients setting the header themselves
+	// get the default.
+	tests := []struct {
+		name   string
+		remote string
+		header string
+		want   string
+	}{
+		{name: "gateway network", remote: "10.1.2.3:5000", header: "premium", want: "premium"},
+		{name: "gateway address", remote: "192.0.2.7:5000", header: "premium", want: "premium"},
+		{name: "mapped address", remote: "[::ffff:10.1.2.3]:5000", header: "premium", want: "premium"},
+		{name: "gateway without header", remote: "10.1.2.3:5000", want: "basic"},
+		{name: "client", remote: "192.0.2.8:5000", header: "premium", want: "basic"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/limited?user=alice", nil)
+			r.RemoteAddr = tt.remote
+			if tt.header != "" {
+				r.Header.Set("X-Tier", tt.header)
+			}
+
+			got, err := tr.ResolveTier(context.Background(), r, "alice")
+			if err != nil {
+				t.Fatalf("resolving tier: %s", err)
+			}
+			if got != tt.want {
+				t.Errorf("got tier %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeaderResolverConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted []string
+	}{
+		{name: "no trusted gateways"},
+		{name: "bad address", trusted: []string{"gateway"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ratelimiter.NewTierResolver(ratelimiter.ResolverConfig{
+				Kind:    ratelimiter.ResolverHeader,
+				Header:  "X-Tier",
+				Trusted: tt.trusted,
+			})
+			if err == nil {
+				t.Errorf("got a resolver, want an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package ratelimiter_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Zanda256/rate-limiter-go/business/data/cache"
+	ratelimiter "github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter"
+	"github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter/fairshare"
+	"github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter/penalty"
+	"github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter/priority"
+)
+
+// taggedStore fails the test when a script is run on several keys that a
+// redis cluster would keep in different slots.
+type taggedStore struct {
+	*cache.RedisCache
+	t *testing.T
+}
+
+func (s taggedStore) RunScript(ctx context.Context, sc *cache.Script, keys []string, args ...any) (any, error) {
+	for _, key := range keys[1:] {
+		if hashTag(key) == "" || hashTag(key) != hashTag(keys[0]) {
+			s.t.Errorf("script run on keys %q, want them to share a hash tag", keys)
+			break
+		}
+	}
+	return s.RedisCache.RunScript(ctx, sc, keys, args...)
+}
+
+func hashTag(key string) string {
+	start := strings.Index(key, "{")
+	if start < 0 {
+		return ""
+	}
+	end := strings.Index(key[start+1:], "}")
+	if end <= 0 {
+		return ""
+	}
+	return key[start+1 : start+1+end]
+}
+
+// newStores returns a redis store, on which the algorithms run their scripts,
+// and a memory store, on which they fall back to compare-and-set.
+func newStores(t *testing.T) (cache.Store, cache.Store) {
+	t.Helper()
+
+	mc := cache.NewMemoryCache(cache.MemoryConfig{})
+	t.Cleanup(mc.Close)
+
+	return taggedStore{RedisCache: newRedis(t), t: t}, mc
+}
+
+// compare runs step against both stores in turn and fails the test when they
+// come to different results.
+func compare(t *testing.T, steps int, script, fallback func(i int) string) {
+	t.Helper()
+
+	for i := 0; i < steps; i++ {
+		got, want := script(i), fallback(i)
+		if got != want {
+			t.Errorf("step %d: got %s from the script, %s from the fallback", i+1, got, want)
+		}
+	}
+}
+
+func TestScripts(t *testing.T) {
+	tiers := map[string]ratelimiter.Tier{
+		"TokenBucket":       {Algo: ratelimiter.TokenBucket},
+		"FixedWindow":       {Algo: ratelimiter.FixedWindow},
+		"LeakyBucket/meter": {Algo: ratelimiter.LeakyBucket},
+		"LeakyBucket/queue": {Algo: ratelimiter.LeakyBucket, Mode: "queue"},
+		"SlidingWindow":     {Algo: ratelimiter.SlidingWindow},
+		"SlidingLog":        {Algo: ratelimiter.SlidingLog},
+		"GCRA":              {Algo: ratelimiter.GCRA},
+		"MultiWindow":       {Limits: []ratelimiter.Limit{{Period: 3600, Capacity: 5}, {Period: 86400, Capacity: 7}}},
+		"Quota":             {Algo: ratelimiter.Quota, Quota: "day"},
+	}
+
+	// Refunds give back the request's units once its decision is taken.
+	costs := []int{1, 2, 1, 3, 1, 1, 2, 1, 1}
+	refunded := map[int]bool{2: true, 5: true}
+
+	for name, tier := range tiers {
+		t.Run(name, func(t *testing.T) {
+			tier.Period = 3600
+			tier.Capacity = 5
+
+			admit := func(store cache.Store) func(i int) string {
+				rl, err := ratelimiter.NewRateLimiter(ratelimiter.RateLimiterConfig{
+					Tier:    tier,
+					KvStore: store,
+					Log:     newLogger(),
+				})
+				if err != nil {
+					t.Fatalf("constructing limiter: %s", err)
+				}
+				return func(i int) string {
+					d, refund := rl.Admit("alice", costs[i])
+					if d.Err != nil {
+						t.Fatalf("step %d: %s", i+1, d.Err)
+					}
+					if refunded[i] && refund != nil {
+						if err := refund(); err != nil {
+							t.Fatalf("step %d: refunding: %s", i+1, err)
+						}
+					}
+					return fmt.Sprintf("allowed %t with %d of %d left", d.Allowed, d.Remaining, d.Limit)
+				}
+			}
+
+			script, fallback := newStores(t)
+			compare(t, len(costs), admit(script), admit(fallback))
+		})
+	}
+}
+
+func TestReservationScripts(t *testing.T) {
+	for _, algo := range []string{ratelimiter.TokenBucket, ratelimiter.GCRA} {
+		t.Run(algo, func(t *testing.T) {
+			reserve := func(store cache.Store) func(i int) string {
+				rl, err := ratelimiter.NewRateLimiter(ratelimiter.RateLimiterConfig{
+					Tier:    ratelimiter.Tier{Algo: algo, Period: 3600, Capacity: 2},
+					KvStore: store,
+					Log:     newLogger(),
+				})
+				if err != nil {
+					t.Fatalf("constructing limiter: %s", err)
+				}
+				return func(i int) string {
+					r, err := rl.Reserve(context.Background(), "alice", 1)
+					if err != nil {
+						t.Fatalf("step %d: %s", i+1, err)
+					}
+					// The third reservation waits for a unit to come back and
+					// is cancelled, so the fourth waits just as long.
+					if i == 2 {
+						if err := r.Cancel(); err != nil {
+							t.Fatalf("step %d: cancelling: %s", i+1, err)
+						}
+					}
+					return fmt.Sprintf("a wait of %s", r.Delay().Round(time.Minute))
+				}
+			}
+
+			script, fallback := newStores(t)
+			compare(t, 4, reserve(script), reserve(fallback))
+		})
+	}
+}
+
+func TestShedScript(t *testing.T) {
+	cfg := priority.Config{
+		Period:       3600,
+		Budget:       6,
+		DefaultClass: "low",
+		Classes: []priority.Class{
+			{Name: "high", Reserved: 3},
+			{Name: "low", Max: 4},
+		},
+	}
+	classes := []string{"low", "low", "low", "high", "low", "low", "high", "high", "high"}
+
+	// The third request is given back, making room for the fifth.
+	refunded := map[int]bool{2: true}
+
+	accept := func(store cache.Store) func(i int) string {
+		s, err := priority.NewShedder(priority.ShedderConfig{Log: newLogger(), Store: store, Config: cfg})
+		if err != nil {
+			t.Fatalf("constructing shedder: %s", err)
+		}
+		return func(i int) string {
+			ok, err := s.Accept(classes[i], 1)
+			if err != nil {
+				t.Fatalf("step %d: %s", i+1, err)
+			}
+			if refunded[i] && ok {
+				if err := s.Refund(classes[i], 1); err != nil {
+					t.Fatalf("step %d: refunding: %s", i+1, err)
+				}
+			}
+			return fmt.Sprintf("accepted %t", ok)
+		}
+	}
+
+	script, fallback := newStores(t)
+	compare(t, len(classes), accept(script), accept(fallback))
+}
+
+func TestDenialScript(t *testing.T) {
+	cfg := penalty.Config{Threshold: 2, Span: 60, Cooldowns: []int{60, 600}, ForgiveAfter: 3600}
+
+	record := func(store cache.Store) func(i int) string {
+		j, err := penalty.NewJail(penalty.JailConfig{Log: newLogger(), Store: store, Config: cfg})
+		if err != nil {
+			t.Fatalf("constructing jail: %s", err)
+		}
+		return func(i int) string {
+			until, err := j.RecordDenial(context.Background(), "alice")
+			if err != nil {
+				t.Fatalf("step %d: %s", i+1, err)
+			}
+			if until.IsZero() {
+				return "no ban"
+			}
+			return fmt.Sprintf("a ban of %s", time.Until(until).Round(time.Minute))
+		}
+	}
+
+	script, fallback := newStores(t)
+	compare(t, 5, record(script), record(fallback))
+}
+
+func TestFairShareScript(t *testing.T) {
+	requests := []struct {
+		user   string
+		weight int
+		cost   int
+	}{
+		{"alice", 1, 2}, {"bob", 2, 3}, {"alice", 1, 2}, {"bob", 2, 4},
+		{"alice", 1, 1}, {"carol", 1, 2}, {"bob", 2, 1},
+	}
+
+	accept := func(store cache.Store) func(i int) string {
+		c := fairshare.NewController(fairshare.ControllerConfig{
+			Log: newLogger(), Store: store, Scope: "global", Period: 3600, Budget: 12,
+		})
+		return func(i int) string {
+			r := requests[i]
+			d := c.Accept(r.user, r.weight, r.cost)
+			if d.Err != nil {
+				t.Fatalf("step %d: %s", i+1, d.Err)
+			}
+			return fmt.Sprintf("allowed %t with %d of %d left", d.Allowed, d.Remaining, d.Limit)
+		}
+	}
+
+	script, fallback := newStores(t)
+	compare(t, len(requests), accept(script), accept(fallback))
+}
@@ -0,0 +1,208 @@
+package slidinglog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"slices"
+	"time"
+
+	"github.com/Zanda256/rate-limiter-go/business/data/cache"
+	"github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter/decision"
+	"github.com/Zanda256/rate-limiter-go/foundation/logger"
+)
+
+const keyPrefix = "slidinglog:"
+
+// logScript trims the entries that left the window from a log and adds the
+// entries of a request to it when they fit.
+//
+//	KEYS[1]   log, a sorted set of entries scored by their time
+//	ARGV[1]   now, unix time in microseconds
+//	ARGV[2]   start of the window, unix time in microseconds
+//	ARGV[3]   ttl of the log, in milliseconds
+//	ARGV[4]   entries allowed in the window
+//	ARGV[5..] entries of the request, one per unit of cost
+//
+// It returns {1, entries, oldest} when the request fits and {0, entries,
+// oldest} when it doesn't, where oldest is the time of the oldest entry, or
+// now when the log is empty.
+var logScript = cache.NewScript(`
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", "(" .. ARGV[2])
+local count = redis.call("ZCARD", KEYS[1])
+local cost = #ARGV - 4
+
+local allowed = 0
+if count + cost <= tonumber(ARGV[4]) then
+	for i = 5, #ARGV do
+		redis.call("ZADD", KEYS[1], ARGV[1], ARGV[i])
+	end
+	redis.call("PEXPIRE", KEYS[1], ARGV[3])
+	count = count + cost
+	allowed = 1
+end
+
+local oldest = tonumber(ARGV[1])
+local first = redis.call("ZRANGE", KEYS[1], 0, 0, "WITHSCORES")
+if #first > 0 then
+	oldest = tonumber(first[2])
+end
+return {allowed, count, oldest}
+`)
+
+// unlogScript removes the ARGV[1] newest entries of the log at KEYS[1].
+var unlogScript = cache.NewScript(`
+redis.call("ZREMRANGEBYRANK", KEYS[1], -tonumber(ARGV[1]), -1)
+return 0
+`)
+
+// LogController enforces an exact limit by recording the timestamp of every
+// admitted request in a per user sorted set. Entries older than WindowSize are
+// trimmed and whatever remains is counted against MaxRequests.
+type LogController struct {
+	Log         *logger.Logger
+	Store       cache.Store
+	WindowSize  int64
+	MaxRequests int
+}
+
+type LogControllerConfig struct {
+	Log         *logger.Logger
+	Store       cache.Store
+	WindowSize  int64
+	MaxRequests int
+}
+
+func NewLogController(cfg LogControllerConfig) *LogController {
+	return &LogController{
+		Log:         cfg.Log,
+		Store:       cfg.Store,
+		WindowSize:  cfg.WindowSize,
+		MaxRequests: cfg.MaxRequests,
+	}
+}
+
+// Accept records one entry per unit of cost in the user's log when the log,
+// once trimmed to the window, has room for all of them. Rejected requests
+// leave the log as it was.
+func (lc *LogController) Accept(userID string, cost int) decision.Decision {
+	now := time.Now()
+	window := time.Duration(lc.WindowSize) * time.Second
+
+	allowed, count, oldest, err := lc.append(userID, cost, now, window)
+	if err != nil {
+		lc.Log.Error(context.Background(), fmt.Sprintf("sliding log: %s", err.Error()))
+		return decision.Error(err)
+	}
+
+	// The log is back to empty once its oldest entry has left the window.
+	resetAt := time.UnixMicro(oldest).Add(window)
+
+	if !allowed {
+		lc.Log.Info(context.Background(), "sliding log limit reached", "userID", userID, "count", count)
+		return decision.Decision{
+			Limit:      lc.MaxRequests,
+			Remaining:  max(0, lc.MaxRequests-int(count)),
+			ResetAt:    resetAt,
+			RetryAfter: time.Until(resetAt),
+		}
+	}
+
+	return decision.Decision{
+		Allowed:   true,
+		Limit:     lc.MaxRequests,
+		Remaining: lc.MaxRequests - int(count),
+		ResetAt:   resetAt,
+	}
+}
+
+// Refund removes cost entries from the user's log, the newest first.
+func (lc *LogController) Refund(userID string, cost int) error {
+	key := keyPrefix + userID
+
+	if sr, ok := lc.Store.(cache.ScriptRunner); ok {
+		_, err := sr.RunScript(context.Background(), unlogScript, []string{key}, cost)
+		return err
+	}
+
+	var entries []int64
+	return cache.UpdateJSON(context.Background(), lc.Store, key, 0, &entries, func(entries *[]int64) (bool, error) {
+		if len(*entries) == 0 {
+			return false, nil
+		}
+		*entries = (*entries)[:max(0, len(*entries)-cost)]
+		return true, nil
+	})
+}
+
+// append trims the entries that left the window from the user's log and adds
+// cost entries at now if they fit. It returns the number of entries left in
+// the log and the time of the oldest one, in microseconds, which is now when
+// the log is empty. It runs logScript, or the same steps through
+// cache.UpdateJSON on stores that can't run scripts.
+func (lc *LogController) append(userID string, cost int, now time.Time, window time.Duration) (bool, int64, int64, error) {
+	sr, ok := lc.Store.(cache.ScriptRunner)
+	if !ok {
+		return lc.appendCAS(userID, cost, now, window)
+	}
+
+	// Two requests can arrive within the same microsecond, the random suffix
+	// keeps their members distinct.
+	prefix := fmt.Sprintf("%d-%d", now.UnixNano(), rand.Int63())
+	args := make([]any, 0, 4+cost)
+	args = append(args, now.UnixMicro(), now.Add(-window).UnixMicro(), window.Milliseconds(), lc.MaxRequests)
+	for i := 0; i < cost; i++ {
+		args = append(args, fmt.Sprintf("%s-%d", prefix, i))
+	}
+
+	res, err := sr.RunScript(context.Background(), logScript, []string{keyPrefix + userID}, args...)
+	if err != nil {
+		return false, 0, 0, err
+	}
+
+	vals, ok := res.([]any)
+	if !ok || len(vals) != 3 {
+		return false, 0, 0, errors.New("unexpected script result")
+	}
+	allowed, ok1 := vals[0].(int64)
+	count, ok2 := vals[1].(int64)
+	oldest, ok3 := vals[2].(int64)
+	if !ok1 || !ok2 || !ok3 {
+		return false, 0, 0, errors.New("unexpected script result")
+	}
+	return allowed == 1, count, oldest, nil
+}
+
+// appendCAS keeps the log as the JSON list of the times of its entries, in
+// microseconds and in the order they were added.
+func (lc *LogController) appendCAS(userID string, cost int, now time.Time, window time.Duration) (bool, int64, int64, error) {
+	ts := now.UnixMicro()
+	minTS := now.Add(-window).UnixMicro()
+
+	var allowed bool
+	var entries []int64
+	err := cache.UpdateJSON(context.Background(), lc.Store, keyPrefix+userID, window, &entries, func(entries *[]int64) (bool, error) {
+		n := len(*entries)
+		*entries = slices.DeleteFunc(*entries, func(e int64) bool {
+			return e < minTS
+		})
+		if allowed = len(*entries)+cost <= lc.MaxRequests; !allowed {
+			// Only write the log back when entries were trimmed.
+			return len(*entries) != n, nil
+		}
+		for i := 0; i < cost; i++ {
+			*entries = append(*entries, ts)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return false, 0, 0, err
+	}
+
+	oldest := ts
+	if len(entries) > 0 {
+		oldest = entries[0]
+	}
+	return allowed, int64(len(entries)), oldest, nil
+}
@@ -0,0 +1,69 @@
+package ratelimiter_test
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/Zanda256/rate-limiter-go/business/data/cache"
+	ratelimiter "github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter"
+	"github.com/Zanda256/rate-limiter-go/foundation/logger"
+	"github.com/alicebob/miniredis/v2"
+)
+
+func newLogger() *logger.Logger {
+	return logger.New(io.Discard, logger.LevelError, "TEST", func(context.Context) string { return "" })
+}
+
+// newRedis returns a store backed by an in-process redis server.
+func newRedis(t *testing.T) *cache.RedisCache {
+	t.Helper()
+	store, err := cache.NewRedisCache(cache.RedisConfig{Addrs: []string{miniredis.RunT(t).Addr()}})
+	if err != nil {
+		t.Fatalf("connecting to redis: %s", err)
+	}
+	return store
+}
+
+func TestDefaultCapacity(t *testing.T) {
+	for _, algo := range ratelimiter.Algorithms() {
+		t.Run(algo, func(t *testing.T) {
+			rl, err := ratelimiter.NewRateLimiter(ratelimiter.RateLimiterConfig{
+				Tier:    ratelimiter.Tier{Algo: algo, Quota: "day"},
+				KvStore: newRedis(t),
+				Log:     newLogger(),
+			})
+			if err != nil {
+				t.Fatalf("constructing limiter: %s", err)
+			}
+
+			for i := 1; i <= ratelimiter.DefaultRateLimitCapacity; i++ {
+				if !rl.CheckUserLimit("alice", 1).Allowed {
+					t.Fatalf("request %d: got denied, want allowed", i)
+				}
+			}
+			if rl.CheckUserLimit("alice", 1).Allowed {
+				t.Errorf("got allowed past the default capacity, want denied")
+			}
+		})
+	}
+}
+
+func TestMultiWindowLimits(t *testing.T) {
+	tests := map[string][]ratelimiter.Limit{
+		"duplicate period": {{Period: 60, Capacity: 10}, {Period: 60, Capacity: 5}},
+		"no capacity":      {{Period: 60}},
+	}
+	for name, limits := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := ratelimiter.NewRateLimiter(ratelimiter.RateLimiterConfig{
+				Tier:    ratelimiter.Tier{Limits: limits},
+				KvStore: newRedis(t),
+				Log:     newLogger(),
+			})
+			if err == nil {
+				t.Errorf("got a limiter for limits %+v, want an error", limits)
+			}
+		})
+	}
+}
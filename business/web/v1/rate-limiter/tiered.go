@@ -0,0 +1,97 @@
+package ratelimiter
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/Zanda256/rate-limiter-go/business/data/cache"
+	"github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter/decision"
+	"github.com/Zanda256/rate-limiter-go/foundation/logger"
+)
+
+// DefaultTier is the tier used when none is configured as the default.
+const DefaultTier = "basic"
+
+// TieredLimiter keeps one limiter per configured tier and enforces the limits
+// of whichever tier the caller resolves to.
+type TieredLimiter struct {
+	resolver    TierResolver
+	limiters    map[string]*RateLimiterImpl
+	defaultTier string
+	log         *logger.Logger
+}
+
+type TieredLimiterConfig struct {
+	Tiers       map[string]Tier
+	DefaultTier string
+	Resolver    TierResolver
+	KvStore     cache.Store
+	Log         *logger.Logger
+}
+
+// NewTieredLimiter builds a limiter for every tier. It fails if any tier names
+// an unknown algorithm or if the default tier isn't configured.
+func NewTieredLimiter(cfg TieredLimiterConfig) (*TieredLimiter, error) {
+	defaultTier := cfg.DefaultTier
+	if defaultTier == "" {
+		defaultTier = DefaultTier
+	}
+	if _, ok := cfg.Tiers[defaultTier]; !ok {
+		return nil, fmt.Errorf("default tier %q is not configured", defaultTier)
+	}
+
+	resolver := cfg.Resolver
+	if resolver == nil {
+		resolver = StaticResolver{Default: defaultTier}
+	}
+
+	limiters := make(map[string]*RateLimiterImpl, len(cfg.Tiers))
+	for name, tier := range cfg.Tiers {
+		rl, err := NewRateLimiter(RateLimiterConfig{
+			Name:    name,
+			Tier:    tier,
+			KvStore: cfg.KvStore,
+			Log:     cfg.Log,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("tier %q: %w", name, err)
+		}
+		limiters[name] = rl
+	}
+
+	return &TieredLimiter{
+		resolver:    resolver,
+		limiters:    limiters,
+		defaultTier: defaultTier,
+		log:         cfg.Log,
+	}, nil
+}
+
+// Limiter returns the limiter of the caller's tier along with the tier name.
+// Callers resolved to a tier that isn't configured get the default tier.
+func (tl *TieredLimiter) Limiter(ctx context.Context, r *http.Request, identity string) (string, *RateLimiterImpl, error) {
+	tier, err := tl.resolver.ResolveTier(ctx, r, identity)
+	if err != nil {
+		return "", nil, err
+	}
+
+	rl, ok := tl.limiters[tier]
+	if !ok {
+		tl.log.Warn(ctx, "unknown tier, using default", "identity", identity, "tier", tier, "default", tl.defaultTier)
+		tier = tl.defaultTier
+		rl = tl.limiters[tier]
+	}
+	return tier, rl, nil
+}
+
+// CheckLimit checks whether the caller may make a request costing cost units
+// under the limits of their tier. Failing to resolve the tier is reported
+// through the decision's Err.
+func (tl *TieredLimiter) CheckLimit(ctx context.Context, r *http.Request, identity string, cost int) Decision {
+	_, rl, err := tl.Limiter(ctx, r, identity)
+	if err != nil {
+		return decision.Error(err)
+	}
+	return rl.CheckUserLimit(identity, cost)
+}
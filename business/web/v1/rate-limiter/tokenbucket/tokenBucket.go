@@ -5,14 +5,15 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"strconv"
 	"time"
 
 	"github.com/Zanda256/rate-limiter-go/business/data/cache"
+	"github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter/decision"
 	"github.com/Zanda256/rate-limiter-go/foundation/logger"
 )
 
-const timeFormat = time.RFC3339
-
 // TokenBucketConfig stores configuration for the token bucket
 type TokenBucketConfig struct {
 	Period   int
@@ -20,13 +21,15 @@ type TokenBucketConfig struct {
 	Capacity int
 }
 
-// TokenBucket is the data representation of a bucket
+// TokenBucket is the data representation of a bucket. Tokens is fractional
+// because the bucket refills continuously; LastUpdate is the unix time in
+// nanoseconds at which Tokens was computed.
 type TokenBucket struct {
-	UserID      string `json:"userID"`       // redis:"userID",
-	Tokens      int    ` json:"tokens"`      // redis:"tokens",
-	NextRefresh string ` json:"nextRefresh"` // redis:"lastSeen",
-	Capacity    int    `json:"capacity"`     // redis:"capacity",
-	Period      int    ` json:"period"`      // redis:"period",
+	UserID     string  `json:"userID"`     // redis:"userID",
+	Tokens     float64 `json:"tokens"`     // redis:"tokens",
+	LastUpdate int64   `json:"lastUpdate"` // redis:"lastUpdate",
+	Capacity   int     `json:"capacity"`   // redis:"capacity",
+	Period     int     ` json:"period"`    // redis:"period",
 }
 
 // To be stored in redis, we need to implement this interface.
@@ -43,141 +46,264 @@ func UnmarshalBinarytoTB(data []byte, t *TokenBucket) error {
 	return nil
 }
 
+const keyPrefix = "tokenbucket:"
+
 func (bc *BucketController) NewBucket(cfg TokenBucketConfig) TokenBucket {
 	return TokenBucket{
-		UserID:      cfg.UserID,
-		Tokens:      cfg.Capacity,
-		Capacity:    cfg.Capacity,
-		NextRefresh: time.Now().Add(time.Duration(cfg.Period) * time.Second).Format(time.RFC3339),
-		Period:      cfg.Period,
+		UserID:     cfg.UserID,
+		Tokens:     float64(cfg.Capacity),
+		Capacity:   cfg.Capacity,
+		LastUpdate: time.Now().UnixNano(),
+		Period:     cfg.Period,
 	}
 }
 
-// BucketController manages bucket creation, and state of individual buckets
+// bucketScript refills a token bucket and takes tokens from it. The bucket is
+// kept in a hash holding its tokens and the time they were counted at.
+//
+//	KEYS[1] bucket
+//	ARGV[1] now, unix time in microseconds
+//	ARGV[2] capacity
+//	ARGV[3] tokens refilled every second
+//	ARGV[4] tokens to take, negative to give tokens back
+//	ARGV[5] 1 to take the tokens even if the bucket goes into debt
+//
+// It returns {1, tokens left} when the tokens were taken, or {0, tokens left}
+// when there weren't enough of them. Tokens are returned as strings because
+// they are fractional.
+var bucketScript = cache.NewScript(`
+local now = tonumber(ARGV[1])
+local capacity = tonumber(ARGV[2])
+local rate = tonumber(ARGV[3])
+local cost = tonumber(ARGV[4])
+
+local state = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(state[1]) or capacity
+local ts = tonumber(state[2]) or now
+if now > ts then
+	tokens = math.min(capacity, tokens + (now - ts) / 1e6 * rate)
+	ts = now
+end
+
+if tokens < cost and ARGV[5] ~= "1" then
+	return {0, tostring(tokens)}
+end
+
+tokens = math.min(capacity, tokens - cost)
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "ts", string.format("%.0f", ts))
+redis.call("PEXPIRE", KEYS[1], math.max(1, math.ceil((capacity - tokens) / rate * 1000)))
+return {1, tostring(tokens)}
+`)
+
+// BucketController manages bucket creation, and state of individual buckets.
+// Buckets hold at most Cap tokens, the largest burst allowed, and refill at
+// the sustained rate of Rate tokens every Period seconds.
 type BucketController struct {
 	Period, Cap int
-	Store       *cache.RedisCache
+	Rate        int
+	Store       cache.Store
 	Log         *logger.Logger
 }
 
+// BucketControllerConfig configures a BucketController. Capacity is the
+// size of the bucket; Rate defaults to it.
 type BucketControllerConfig struct {
-	Store    *cache.RedisCache
+	Store    cache.Store
 	Log      *logger.Logger
 	Period   int
 	Capacity int
+	Rate     int
 }
 
 func NewBucketController(cfg BucketControllerConfig) *BucketController {
+	rate := cfg.Rate
+	if rate < 1 {
+		rate = cfg.Capacity
+	}
 	return &BucketController{
 		Period: cfg.Period,
 		Cap:    cfg.Capacity,
+		Rate:   rate,
 		Store:  cfg.Store,
 		Log:    cfg.Log,
 	}
 }
 
-func (bc *BucketController) Accept(userID string) bool {
-	v, err := bc.getBucket(userID)
+// Accept takes cost tokens from the user's bucket, reporting whether there
+// were enough of them. The bucket is topped up with the tokens that were
+// refilled since it was last updated first. Costs below a single token fail,
+// as taking them would fill the bucket.
+func (bc *BucketController) Accept(userID string, cost int) decision.Decision {
+	if cost < 1 {
+		return decision.Error(fmt.Errorf("cost %d must be at least 1", cost))
+	}
+	if cost > bc.Cap {
+		bc.Log.Info(context.Background(), "cost exceeds bucket capacity", "userID", userID, "cost", cost)
+		return decision.Decision{Limit: bc.Cap}
+	}
+
+	now := time.Now()
+
+	allowed, buckt, err := bc.take(userID, cost, now, false)
 	if err != nil {
-		// If the key isn't present, create a new one
-		if errors.Is(err, cache.ErrKeyNotFound) { // move to string constatnt later
-			buckt := bc.NewBucket(TokenBucketConfig{
-				Period:   bc.Period, // TODO: this should not be a property of the bucket controller
-				UserID:   userID,
-				Capacity: bc.Cap, // TODO: this should not be a property of the bucket controller
-			})
-			if _, err = bc.updateTokens(buckt); err != nil {
-				bc.Log.Error(context.Background(), fmt.Sprintf("updateTokens: %s", err.Error()))
-				return false
-			}
-			bc.Log.Info(context.Background(), "successfully stored new value", buckt)
-			//If no error accept the request
-			return true
-		}
-		// Other error type we log it and return false
-		bc.Log.Error(context.Background(), fmt.Sprintf("Store bucket value failed: %s", err.Error()))
-		return false
+		bc.Log.Error(context.Background(), fmt.Sprintf("token bucket: %s", err.Error()))
+		return decision.Error(err)
 	}
-	buckt := TokenBucket{}
-	var (
-		t  string
-		ok bool
-	)
 
-	if t, ok = v.(string); !ok {
-		bc.Log.Info(context.Background(), "cannot marshal retrieved value into string")
-		return false
+	d := bc.decide(buckt, now, allowed)
+	if !allowed {
+		d.RetryAfter = bc.timeToRefill(float64(cost) - buckt.Tokens)
 	}
+	return d
+}
 
-	if err = UnmarshalBinarytoTB([]byte(t), &buckt); err != nil {
-		bc.Log.Info(context.Background(), "cannot marshal retrieved value into TokenBucket")
-		return false
+// Reserve takes cost tokens from the user's bucket even if they haven't been
+// refilled yet, leaving the bucket in debt, and returns how long the caller
+// has to wait until they have been.
+func (bc *BucketController) Reserve(userID string, cost int) (time.Duration, error) {
+	if cost < 1 {
+		return 0, fmt.Errorf("cost %d must be at least 1", cost)
+	}
+	if cost > bc.Cap {
+		return 0, fmt.Errorf("cost %d exceeds bucket capacity of %d", cost, bc.Cap)
 	}
-	bc.Log.Info(context.Background(), "successfully retrieved value", "buckt", buckt)
 
-	nextRefresh, err := time.Parse(timeFormat, buckt.NextRefresh)
+	_, buckt, err := bc.take(userID, cost, time.Now(), true)
 	if err != nil {
-		bc.Log.Info(context.Background(), "cannot Parse time value")
-		return false
+		return 0, err
 	}
 
-	// If user is ready for next token refresh, refill bucket
-	if time.Now().After(nextRefresh) {
-		if err = bc.refreshTokens(&buckt); err != nil {
-			bc.Log.Error(context.Background(), "refresh tokens failed:", err.Error())
-			return false
-		}
-		if _, err = bc.updateTokens(buckt); err != nil {
-			bc.Log.Error(context.Background(), fmt.Sprintf("updateTokens: %s", err.Error()))
-			return false
-		}
-		return true
-	}
-	// User has no tokens left, return false
-	if buckt.Tokens < 1 {
-		return false
-	} else {
-		if _, err = bc.updateTokens(buckt); err != nil {
-			bc.Log.Error(context.Background(), fmt.Sprintf("updateTokens: %s", err.Error()))
-			return false
-		}
-		return true
+	if buckt.Tokens >= 0 {
+		return 0, nil
 	}
+	return bc.timeToRefill(-buckt.Tokens), nil
 }
 
-func (bc *BucketController) getBucket(UserID string) (any, error) {
-	v, err := bc.Store.RetrieveValue(context.Background(), UserID)
+// CancelReservation puts cost reserved tokens back into the user's bucket,
+// never filling it past capacity. Refund gives tokens back the same way.
+func (bc *BucketController) CancelReservation(userID string, cost int) error {
+	if cost < 1 {
+		return fmt.Errorf("cost %d must be at least 1", cost)
+	}
+	_, _, err := bc.take(userID, -cost, time.Now(), true)
+	return err
+}
+
+// Refund puts cost tokens back into the user's bucket, like
+// CancelReservation.
+func (bc *BucketController) Refund(userID string, cost int) error {
+	return bc.CancelReservation(userID, cost)
+}
+
+// take refills the user's bucket up to now and takes cost tokens from it if
+// there are enough of them, or regardless when debt is set. A negative cost
+// gives tokens back, never filling the bucket past capacity. Users without a
+// bucket get a full one.
+func (bc *BucketController) take(userID string, cost int, now time.Time, debt bool) (bool, TokenBucket, error) {
+	sr, ok := bc.Store.(cache.ScriptRunner)
+	if !ok {
+		return bc.takeCAS(userID, cost, now, debt)
+	}
+
+	var debtArg int
+	if debt {
+		debtArg = 1
+	}
+	res, err := sr.RunScript(context.Background(), bucketScript, []string{keyPrefix + userID},
+		now.UnixMicro(), bc.Cap, bc.rate(), cost, debtArg)
 	if err != nil {
-		bc.Log.Error(context.Background(), "checkbucket: %s", err.Error())
-		return nil, err
+		return false, TokenBucket{}, err
+	}
+
+	vals, ok := res.([]any)
+	if !ok || len(vals) != 2 {
+		return false, TokenBucket{}, errors.New("unexpected script result")
 	}
-	if v == nil {
-		bc.Log.Warn(context.Background(), "key not found")
-		return nil, cache.ErrKeyNotFound
+	allowed, ok1 := vals[0].(int64)
+	left, ok2 := vals[1].(string)
+	if !ok1 || !ok2 {
+		return false, TokenBucket{}, errors.New("unexpected script result")
 	}
-	bc.Log.Info(context.Background(), "bucket in check bucket: %+v", v)
-	return v, nil
+	tokens, err := strconv.ParseFloat(left, 64)
+	if err != nil {
+		return false, TokenBucket{}, fmt.Errorf("parsing tokens: %w", err)
+	}
+
+	buckt := bc.NewBucket(TokenBucketConfig{
+		Period:   bc.Period,
+		UserID:   userID,
+		Capacity: bc.Cap,
+	})
+	buckt.Tokens = tokens
+	buckt.LastUpdate = now.UnixNano()
+	return allowed == 1, buckt, nil
 }
 
-func (bc *BucketController) updateTokens(b TokenBucket) (TokenBucket, error) {
-	// Decrement tokens by 1 and persist the result. If successful,accept and process the request.
-	b.Tokens -= 1
-	res, err := bc.Store.StoreValue(context.Background(), b.UserID, b, 30)
+func (bc *BucketController) takeCAS(userID string, cost int, now time.Time, debt bool) (bool, TokenBucket, error) {
+	// An idle bucket is full again once it has refilled, so it can expire
+	// then. Buckets in debt take longer, their expiry is pushed back below.
+	key := keyPrefix + userID
+	ttl := bc.timeToRefill(float64(bc.Cap))
+
+	var allowed bool
+	var buckt TokenBucket
+	err := cache.UpdateJSON(context.Background(), bc.Store, key, ttl, &buckt, func(b *TokenBucket) (bool, error) {
+		if b.UserID == "" {
+			// If the key isn't present, start with a full bucket
+			*b = bc.NewBucket(TokenBucketConfig{
+				Period:   bc.Period,
+				UserID:   userID,
+				Capacity: bc.Cap,
+			})
+		}
+		bc.refill(b, now)
+
+		if allowed = b.Tokens >= float64(cost) || debt; !allowed {
+			return false, nil
+		}
+		b.Tokens = math.Min(float64(bc.Cap), b.Tokens-float64(cost))
+		return true, nil
+	})
 	if err != nil {
-		bc.Log.Error(context.Background(), fmt.Sprintf("Store bucket value failed: %s", err.Error()))
-		return TokenBucket{}, err
+		return false, TokenBucket{}, err
 	}
-	buckt := res.(TokenBucket)
-	return buckt, nil
+
+	if buckt.Tokens < 0 {
+		if err := bc.Store.Expire(context.Background(), key, bc.timeToRefill(float64(bc.Cap)-buckt.Tokens)); err != nil {
+			return false, TokenBucket{}, err
+		}
+	}
+	return allowed, buckt, nil
 }
 
-func (bc *BucketController) refreshTokens(bucket *TokenBucket) error {
-	bucket.Tokens = bucket.Capacity
-	bucket.NextRefresh = time.Now().Add(time.Duration(bucket.Period) * time.Second).Format(timeFormat)
-	bc.Log.Info(context.Background(), fmt.Sprintf("refreshing tokens: %+v", bucket))
-	_, err := bc.Store.StoreValue(context.Background(), bucket.UserID, *bucket, 30)
-	if err != nil {
-		return err
+// decide builds the decision for the bucket as it was left by the request.
+// The bucket resets once it has refilled to capacity.
+func (bc *BucketController) decide(b TokenBucket, now time.Time, allowed bool) decision.Decision {
+	return decision.Decision{
+		Allowed:   allowed,
+		Limit:     b.Capacity,
+		Remaining: max(0, int(math.Floor(b.Tokens))),
+		ResetAt:   now.Add(bc.timeToRefill(float64(b.Capacity) - b.Tokens)),
 	}
-	return nil
+}
+
+// rate returns how many tokens are refilled every second.
+func (bc *BucketController) rate() float64 {
+	return float64(bc.Rate) / float64(bc.Period)
+}
+
+// timeToRefill returns how long it takes to refill n tokens.
+func (bc *BucketController) timeToRefill(n float64) time.Duration {
+	return time.Duration(n / bc.rate() * float64(time.Second))
+}
+
+// refill adds the tokens refilled since the bucket was last updated, never
+// filling it past capacity.
+func (bc *BucketController) refill(b *TokenBucket, now time.Time) {
+	elapsed := time.Duration(now.UnixNano() - b.LastUpdate)
+	if elapsed > 0 {
+		b.Tokens = math.Min(float64(bc.Cap), b.Tokens+elapsed.Seconds()*bc.rate())
+		b.LastUpdate = now.UnixNano()
+	}
+	b.Capacity = bc.Cap
 }
@@ -0,0 +1,175 @@
+package ratelimiter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// minPollInterval is how long Wait sleeps between attempts when a limiter
+// doesn't say when to retry.
+const minPollInterval = 10 * time.Millisecond
+
+// Reserver is implemented by limiters that can hand out units ahead of time.
+// Reserve takes cost units from the user's limit straight away and returns
+// how long the caller has to wait before using them. CancelReservation gives
+// units back.
+type Reserver interface {
+	Reserve(userID string, cost int) (time.Duration, error)
+	CancelReservation(userID string, cost int) error
+}
+
+// Reservation holds units reserved for a caller until they may be used.
+type Reservation struct {
+	rl        *RateLimiterImpl
+	userID    string
+	cost      int
+	timeToAct time.Time
+
+	mu       sync.Mutex
+	canceled bool
+}
+
+// Delay returns how long the caller has to wait before acting on the
+// reservation.
+func (r *Reservation) Delay() time.Duration {
+	return max(0, time.Until(r.timeToAct))
+}
+
+// Cancel gives the reserved units back so that other requests can use them.
+// Reservations that could already have been acted on are left alone, as
+// their units may have been used. Cancel may be called more than once.
+func (r *Reservation) Cancel() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.canceled || !time.Now().Before(r.timeToAct) {
+		return nil
+	}
+	r.canceled = true
+
+	return r.rl.Limiter.(Reserver).CancelReservation(r.userID, r.cost)
+}
+
+// Reserve reserves cost units of the user's limit. It fails if the algorithm
+// of the limiter doesn't implement Reserver or if cost units will never be
+// available at once, or if cost is below a single unit. Nothing is reserved
+// once ctx is done.
+func (rl *RateLimiterImpl) Reserve(ctx context.Context, userID string, cost int) (*Reservation, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := checkCost(cost); err != nil {
+		return nil, err
+	}
+
+	rsv, ok := rl.Limiter.(Reserver)
+	if !ok {
+		return nil, fmt.Errorf("the %s algorithm doesn't support reservations", rl.Algo)
+	}
+
+	delay, err := rsv.Reserve(userID, cost)
+	if err != nil {
+		return nil, fmt.Errorf("reserving %d units: %w", cost, err)
+	}
+
+	return &Reservation{
+		rl:        rl,
+		userID:    userID,
+		cost:      cost,
+		timeToAct: time.Now().Add(delay),
+	}, nil
+}
+
+// Wait blocks until the user may make a request costing cost units, or until
+// ctx is done. Limiters that implement Reserver reserve the units and sleep
+// for as long as they say; the reservation is cancelled if ctx ends first or
+// its deadline is too close. Other limiters are polled until they admit the
+// request, and then waited on for as long as the decision is delayed; the
+// units are given back if ctx ends first. Costs below a single unit are
+// rejected, and so are limiters that implement Observer, as Wait has no way to
+// report how the request fared.
+func (rl *RateLimiterImpl) Wait(ctx context.Context, userID string, cost int) error {
+	if err := checkCost(cost); err != nil {
+		return err
+	}
+	if _, ok := rl.Limiter.(Observer); ok {
+		return fmt.Errorf("the %s algorithm needs admitted requests to be observed, it can't be waited on", rl.Algo)
+	}
+
+	if _, ok := rl.Limiter.(Reserver); ok {
+		return rl.waitReserved(ctx, userID, cost)
+	}
+
+	for {
+		d, refund := rl.Admit(userID, cost)
+		switch {
+		case d.Err != nil:
+			return d.Err
+		case d.Allowed:
+			return waitDelay(ctx, d.Delay, refund)
+		case d.Limit > 0 && cost > d.Limit:
+			return fmt.Errorf("cost %d exceeds the %s limit of %d", cost, d.Policy, d.Limit)
+		}
+
+		if err := Sleep(ctx, max(d.RetryAfter, minPollInterval)); err != nil {
+			return err
+		}
+	}
+}
+
+func (rl *RateLimiterImpl) waitReserved(ctx context.Context, userID string, cost int) error {
+	r, err := rl.Reserve(ctx, userID, cost)
+	if err != nil {
+		return err
+	}
+
+	delay := r.Delay()
+	if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+		if err := r.Cancel(); err != nil {
+			return err
+		}
+		return errors.New("waiting would exceed the context deadline")
+	}
+
+	if err := Sleep(ctx, delay); err != nil {
+		if cerr := r.Cancel(); cerr != nil {
+			return errors.Join(err, cerr)
+		}
+		return err
+	}
+	return nil
+}
+
+// waitDelay waits out the delay of an admitted request, giving its units back
+// if ctx ends first.
+func waitDelay(ctx context.Context, delay time.Duration, refund RefundFunc) error {
+	err := Sleep(ctx, delay)
+	if err == nil || refund == nil {
+		return err
+	}
+	if rerr := refund(); rerr != nil {
+		return errors.Join(err, rerr)
+	}
+	return err
+}
+
+// Sleep waits for d to elapse or ctx to be done, whichever comes first. It
+// returns the error of ctx in the latter case.
+func Sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
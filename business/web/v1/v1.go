@@ -2,34 +2,49 @@ package v1
 
 import (
 	"os"
+	"time"
 
 	"github.com/Zanda256/rate-limiter-go/business/data/cache"
 	"github.com/Zanda256/rate-limiter-go/business/web/v1/mid"
 	ratelimiter "github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter"
+	"github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter/penalty"
+	"github.com/Zanda256/rate-limiter-go/business/web/v1/rate-limiter/priority"
 	"github.com/Zanda256/rate-limiter-go/foundation/logger"
 	"github.com/Zanda256/rate-limiter-go/foundation/web"
 )
 
 // APIMuxConfig contains all the mandatory systems required by handlers.
 type APIMuxConfig struct {
-	Tiers    map[string]ratelimiter.Tier
-	RedisKv  *cache.RedisCache
-	Build    string
-	Shutdown chan os.Signal
-	Log      *logger.Logger
+	Tiers             map[string]ratelimiter.Tier
+	DefaultTier       string
+	TierResolver      ratelimiter.TierResolver
+	MaxInFlight       int
+	InFlightOnFailure string
+	Hierarchy         []ratelimiter.LevelConfig
+	Global            *ratelimiter.GlobalConfig
+	Priority          *priority.Config
+	Penalty           *penalty.Config
+	OperatorKey       string
+	KvStore           cache.Store
+	MaxDelay          time.Duration
+	Build             string
+	Shutdown          chan os.Signal
+	Log               *logger.Logger
 }
 
 // RouteAdder defines behavior that sets the routes to bind for an instance
 // of the service.
 type RouteAdder interface {
-	Add(app *web.App, cfg APIMuxConfig)
+	Add(app *web.App, cfg APIMuxConfig) error
 }
 
 // APIMux constructs a http.Handler with all application routes defined.
-func APIMux(cfg APIMuxConfig, routeAdder RouteAdder) *web.App {
+func APIMux(cfg APIMuxConfig, routeAdder RouteAdder) (*web.App, error) {
 	app := web.NewApp(cfg.Shutdown, mid.Logger(cfg.Log), mid.Errors(cfg.Log))
 
-	routeAdder.Add(app, cfg)
+	if err := routeAdder.Add(app, cfg); err != nil {
+		return nil, err
+	}
 
-	return app
+	return app, nil
 }
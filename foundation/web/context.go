@@ -16,6 +16,18 @@ type Values struct {
 	StatusCode int
 }
 
+// GetValues returns the values from the context.
+func GetValues(ctx context.Context) *Values {
+	v, ok := ctx.Value(key).(*Values)
+	if !ok {
+		return &Values{
+			TraceID: "00000000-0000-0000-0000-000000000000",
+			Now:     time.Now(),
+		}
+	}
+	return v
+}
+
 // GetTraceID returns the trace id from the context.
 func GetTraceID(ctx context.Context) string {
 	v, ok := ctx.Value(key).(*Values)
@@ -24,3 +36,16 @@ func GetTraceID(ctx context.Context) string {
 	}
 	return v.TraceID
 }
+
+// SetStatusCode sets the status code back into the context.
+func SetStatusCode(ctx context.Context, statusCode int) {
+	v, ok := ctx.Value(key).(*Values)
+	if !ok {
+		return
+	}
+	v.StatusCode = statusCode
+}
+
+func setValues(ctx context.Context, v *Values) context.Context {
+	return context.WithValue(ctx, key, v)
+}
@@ -8,7 +8,7 @@ import (
 
 // Respond converts a Go value to JSON and sends it to the client.
 func Respond(ctx context.Context, w http.ResponseWriter, data any, statusCode int) error {
-	//SetStatusCode(ctx, statusCode)
+	SetStatusCode(ctx, statusCode)
 
 	//if statusCode == http.StatusNoContent {
 	//	w.WriteHeader(statusCode)
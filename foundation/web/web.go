@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"os"
 	"syscall"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 )
@@ -51,7 +52,11 @@ func (a *App) HandlePath(method string, group string, path string, handler Handl
 // to the application server mux.
 func (a *App) handle(method string, group string, path string, handler Handler) {
 	h := func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-		ctx := context.Background()
+		v := Values{
+			Now: time.Now().UTC(),
+		}
+		ctx := setValues(r.Context(), &v)
+
 		if err := handler(ctx, w, r); err != nil {
 			if validateShutdown(err) {
 				a.SignalShutdown()
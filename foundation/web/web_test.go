@@ -0,0 +1,31 @@
+package web_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/Zanda256/rate-limiter-go/foundation/web"
+)
+
+func TestHandlerContext(t *testing.T) {
+	app := web.NewApp(make(chan os.Signal, 1))
+
+	var err error
+	app.HandlePath(http.MethodGet, "v1", "/", func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		err = ctx.Err()
+		return nil
+	})
+
+	// Handlers must see the request end when the client goes away.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := httptest.NewRequest(http.MethodGet, "/v1/", nil).WithContext(ctx)
+	app.ServeHTTP(httptest.NewRecorder(), r)
+
+	if err != context.Canceled {
+		t.Errorf("got %v, want the handler's context cancelled with the request's", err)
+	}
+}
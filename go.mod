@@ -3,6 +3,7 @@ module github.com/Zanda256/rate-limiter-go
 go 1.21.1
 
 require (
+	github.com/alicebob/miniredis/v2 v2.39.0
 	github.com/julienschmidt/httprouter v1.3.0
 	github.com/redis/go-redis/v9 v9.4.0
 )
@@ -10,4 +11,5 @@ require (
 require (
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/yuin/gopher-lua v1.1.1 // indirect
 )